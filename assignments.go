@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/bedrockteam/skin-bot/utils"
+	"github.com/sirupsen/logrus"
+)
+
+// time between checking the leases
+var assignmentPoll = 5 * time.Second
+
+// runAssignments runs a bot on every server instance the api server leases to this node until ctx is done
+func runAssignments(ctx context.Context, config *Config, client *utils.Client, metrics *Metrics) {
+	assignments := client.StartAssignments(config.Node.Capacity)
+
+	// lease id -> stops its bot
+	running := make(map[string]context.CancelFunc)
+	for {
+		current := make(map[string]bool)
+		for _, a := range assignments.Current() {
+			current[a.LeaseId] = true
+			if _, ok := running[a.LeaseId]; ok || !canStartBot(a.Address) {
+				continue
+			}
+
+			user, ok := config.pickUser(a.Server)
+			if !ok {
+				logrus.Warnf("No user may join %s", a.Server)
+				continue
+			}
+			ip, _, _ := strings.Cut(a.Address, ":")
+			bot_ctx, cancel := context.WithCancel(ctx)
+			running[a.LeaseId] = cancel
+			b := NewBot(client, metrics, user.account(), a.Address, fmt.Sprintf("%s %s", a.Server, ip))
+			go b.Start(bot_ctx)
+			logrus.Infof("Started Bot as %s on assigned %s %s", user.Name, a.Server, a.Address)
+		}
+
+		for lease, cancel := range running {
+			if !current[lease] {
+				cancel()
+				delete(running, lease)
+				logrus.Infof("Lease %s ended, stopped its bot", lease)
+			}
+		}
+
+		select {
+		case <-time.After(assignmentPoll):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
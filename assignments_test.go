@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/bedrockteam/skin-bot/utils"
+	"github.com/bedrockteam/skin-bot/utils/apitest"
+	"github.com/sandertv/gophertunnel/minecraft"
+)
+
+func TestAssignmentEndStopsBot(t *testing.T) {
+	assignmentPoll = 50 * time.Millisecond
+
+	listener, err := minecraft.ListenConfig{AuthenticationDisabled: true}.Listen("raknet", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	// the server spawns the bot and then stays silent, like a server without players
+	spawned := make(chan struct{})
+	go func() {
+		c, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		if err := c.(*minecraft.Conn).StartGame(minecraft.GameData{}); err != nil {
+			return
+		}
+		close(spawned)
+	}()
+
+	// a short lease, the node sees it end without waiting for a renewal
+	server := apitest.NewServer("key")
+	t.Cleanup(server.Close)
+	server.SetAssignments([]utils.Assignment{{
+		LeaseId: "lease-1",
+		Server:  "play.example.com",
+		Address: listener.Addr().String(),
+		Expires: time.Now().Add(3 * time.Second).Unix(),
+	}})
+
+	client := startClient(t, server, utils.QueueConfig{})
+	client.NodeId = "node-1"
+	client.StartNode(utils.NodeConfig{Register: true}, utils.NodeInfo{}, func() utils.NodeStatus { return utils.NodeStatus{} })
+
+	config := &Config{
+		Users:          []UserConfig{{Name: "bot1", Offline: true}},
+		OfflineServers: []string{"play.example.com"},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go runAssignments(ctx, config, client, NewMetrics())
+
+	select {
+	case <-spawned:
+	case <-time.After(10 * time.Second):
+		t.Fatal("bot did not join the assigned server")
+	}
+
+	// the lease goes to another node, this bot has to leave before that one joins
+	server.SetAssignments(nil)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		bots_lock.Lock()
+		_, running := bots[listener.Addr().String()]
+		bots_lock.Unlock()
+		if !running {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("bot stayed on the server after its lease ended")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/bedrockteam/skin-bot/utils"
+)
+
+const accountsUsage = "usage: accounts login|refresh|remove|check <name> or accounts list"
+
+// accountsCommand manages the xbox logins of the users, the bots never ask for one
+//
+//	skin-bot accounts login <name>
+//	skin-bot accounts list
+//	skin-bot accounts refresh <name>
+//	skin-bot accounts remove <name>
+//	skin-bot accounts check [name]
+func accountsCommand(ctx context.Context, args []string) error {
+	if len(args) < 1 {
+		return fmt.Errorf(accountsUsage)
+	}
+	if args[0] == "list" {
+		return listAccounts()
+	}
+	if args[0] == "check" && len(args) == 1 {
+		return checkAccounts(ctx)
+	}
+	if len(args) != 2 {
+		return fmt.Errorf(accountsUsage)
+	}
+
+	name := args[1]
+	switch args[0] {
+	case "login":
+		if err := utils.LoginAccount(name, os.Stdout); err != nil {
+			return err
+		}
+		fmt.Printf("logged in %s\n", name)
+	case "refresh":
+		token, err := utils.RefreshAccount(name)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("refreshed %s, valid until %s\n", name, token.Expiry.Format(time.RFC3339))
+	case "remove":
+		if err := utils.RemoveAccount(name); err != nil {
+			return err
+		}
+		fmt.Printf("removed %s\n", name)
+	case "check":
+		if err := utils.CheckAccount(ctx, name); err != nil {
+			return err
+		}
+		fmt.Printf("%s ok\n", name)
+	default:
+		return fmt.Errorf(accountsUsage)
+	}
+	return nil
+}
+
+// listAccounts prints the saved logins and which users from the config have none
+func listAccounts() error {
+	accounts, err := utils.ListAccounts()
+	if err != nil {
+		return err
+	}
+	saved := make(map[string]bool)
+	for _, a := range accounts {
+		saved[a.Name] = true
+		state := "valid"
+		if !a.Expiry.IsZero() && time.Now().After(a.Expiry) {
+			state = "expired, refreshed on use"
+		}
+		fmt.Printf("%s\t%s\t%s\n", a.Name, a.Expiry.Format(time.RFC3339), state)
+	}
+
+	config, err := readConfig()
+	if err != nil {
+		return err
+	}
+	for _, user := range config.Users {
+		if !user.Offline && !saved[user.Name] {
+			fmt.Printf("%s\t-\tnot logged in\n", user.Name)
+		}
+	}
+	return nil
+}
+
+// checkAccounts checks every online user from the config
+func checkAccounts(ctx context.Context) error {
+	config, err := readConfig()
+	if err != nil {
+		return err
+	}
+	failed := 0
+	for _, user := range config.Users {
+		if user.Offline {
+			continue
+		}
+		if err := utils.CheckAccount(ctx, user.Name); err != nil {
+			fmt.Printf("%s: %s\n", user.Name, err)
+			failed++
+			continue
+		}
+		fmt.Printf("%s ok\n", user.Name)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d accounts failed", failed)
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/bedrockteam/skin-bot/utils"
+	"github.com/sirupsen/logrus"
+)
+
+// archiveCommand moves the local archive between machines
+//
+//	skin-bot archive export <file.tar.gz>
+//	skin-bot archive import <file.tar.gz>
+//	skin-bot archive prune
+func archiveCommand(ctx context.Context, args []string) error {
+	if len(args) < 1 {
+		return fmt.Errorf("usage: archive export|import|prune [file]")
+	}
+
+	config, err := readConfig()
+	if err != nil {
+		return err
+	}
+	if config.Archive.Dir == "" {
+		return fmt.Errorf("Archive.Dir undefined")
+	}
+	archive, err := utils.OpenArchive(config.Archive)
+	if err != nil {
+		return err
+	}
+	defer archive.Close()
+
+	switch args[0] {
+	case "export", "import":
+		if len(args) < 2 {
+			return fmt.Errorf("usage: archive %s <file.tar.gz>", args[0])
+		}
+		if args[0] == "export" {
+			f, err := os.Create(args[1])
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			if err := archive.Export(f); err != nil {
+				return err
+			}
+			logrus.Infof("Exported archive to %s", args[1])
+			return f.Sync()
+		}
+
+		f, err := os.Open(args[1])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		imported, err := archive.Import(f)
+		if err != nil {
+			return err
+		}
+		logrus.Infof("Imported %d new skins from %s", imported, args[1])
+		return nil
+	case "prune":
+		return archive.Prune()
+	}
+	return fmt.Errorf("unknown archive command %s", args[0])
+}
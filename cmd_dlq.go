@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+)
+
+// dlqCommand shows or requeues the skins in the dead letter queue
+//
+//	skin-bot dlq list [-n 100]
+//	skin-bot dlq requeue [-n 0]
+func dlqCommand(ctx context.Context, args []string) error {
+	if len(args) < 1 {
+		return fmt.Errorf("usage: dlq list|requeue [-n count]")
+	}
+	flags := flag.NewFlagSet("dlq", flag.ContinueOnError)
+	limit := flags.Int("n", 0, "max skins, 0 for all")
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	client, err := connectQueue()
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	switch args[0] {
+	case "list":
+		if *limit == 0 {
+			*limit = 100
+		}
+		dead, err := client.Queue().ListDeadLetters(ctx, *limit)
+		if err != nil {
+			return err
+		}
+		for _, d := range dead {
+			fmt.Printf("%s\t%s\t%d bytes\t%s\t%s\n", d.MessageId, d.ContentType, d.Size, d.Queue, d.Reason)
+		}
+		fmt.Printf("%d dead skins\n", len(dead))
+	case "requeue":
+		count, err := client.Queue().RequeueDeadLetters(ctx, *limit)
+		fmt.Printf("requeued %d skins\n", count)
+		return err
+	default:
+		return fmt.Errorf("usage: dlq list|requeue [-n count]")
+	}
+	return nil
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/bedrockteam/skin-bot/utils"
+	"github.com/sirupsen/logrus"
+)
+
+// connectQueue starts an api client that only talks to the queue
+func connectQueue() (*utils.Client, error) {
+	config, err := readConfig()
+	if err != nil {
+		return nil, err
+	}
+	client, err := utils.NewClient(config.API, nil, config.Queue)
+	if err != nil {
+		return nil, err
+	}
+	if err := client.Start(true); err != nil {
+		client.Close()
+		return nil, err
+	}
+	if client.Queue() == nil {
+		client.Close()
+		return nil, fmt.Errorf("the API server did not provide an AMQPUrl")
+	}
+	return client, nil
+}
+
+// relayDedupe remembers which skin every player had recently
+type relayDedupe struct {
+	ttl  time.Duration
+	seen map[string]relaySeen
+}
+
+type relaySeen struct {
+	hash string
+	time time.Time
+}
+
+// isNew returns false if this player had this skin within ttl, the hash is what remember takes
+func (d *relayDedupe) isNew(skin *utils.QueuedSkin) (string, bool, error) {
+	hash, err := utils.SkinHash(skin.Skin)
+	if err != nil {
+		return "", false, err
+	}
+	if s, ok := d.seen[skin.Xuid]; ok && s.hash == hash && time.Since(s.time) < d.ttl {
+		return hash, false, nil
+	}
+	return hash, true, nil
+}
+
+// remember records that the skin with hash of xuid was published
+func (d *relayDedupe) remember(xuid, hash string) {
+	d.seen[xuid] = relaySeen{hash, time.Now()}
+}
+
+func (d *relayDedupe) expire() {
+	now := time.Now()
+	for xuid, s := range d.seen {
+		if now.Sub(s.time) >= d.ttl {
+			delete(d.seen, xuid)
+		}
+	}
+}
+
+// relayCommand consumes player_skins, drops invalid and duplicate skins and publishes the rest to new_skins.
+// capes the bots sent as a CapeRef are filled in from the capes the relay has seen
+//
+//	skin-bot relay [-dedupe 1h] [-capes relay-capes.json]
+func relayCommand(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("relay", flag.ContinueOnError)
+	dedupe_ttl := flags.Duration("dedupe", 1*time.Hour, "drop skins a player already had within this time")
+	capes_file := flags.String("capes", "relay-capes.json", "cape catalog used to resolve CapeRefs, empty to pass them on")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	client, err := connectQueue()
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	if *capes_file != "" {
+		capes, err := utils.OpenCapeCatalog(utils.CapeCatalogConfig{File: *capes_file})
+		if err != nil {
+			return err
+		}
+		client.Capes = capes
+	}
+
+	dedupe := &relayDedupe{ttl: *dedupe_ttl, seen: make(map[string]relaySeen)}
+	var dedupe_lock sync.Mutex
+	go func() {
+		expire := time.NewTicker(10 * time.Minute)
+		defer expire.Stop()
+		for {
+			select {
+			case <-expire.C:
+				dedupe_lock.Lock()
+				dedupe.expire()
+				dedupe_lock.Unlock()
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	err = client.WithQueue(func(q *utils.MQ) error {
+		return q.ConsumeSkins(ctx, func(ctx context.Context, skin *utils.QueuedSkin) error {
+			if client.Capes != nil && !client.Capes.Resolve(skin) {
+				logrus.Warnf("Relay: unknown cape %s, passing on the skin of %s without it", skin.CapeRef, skin.Username)
+			}
+			if err := utils.ValidateSkin(skin); err != nil {
+				return &utils.PoisonError{Err: err}
+			}
+			dedupe_lock.Lock()
+			hash, ok, err := dedupe.isNew(skin)
+			dedupe_lock.Unlock()
+			if err != nil {
+				return &utils.PoisonError{Err: err}
+			}
+			if !ok {
+				return nil
+			}
+
+			// only remembered once published, a failed publish is requeued and has to pass again
+			if err := q.PubSubSkin(ctx, skin); err != nil {
+				return err
+			}
+			dedupe_lock.Lock()
+			dedupe.remember(skin.Xuid, hash)
+			dedupe_lock.Unlock()
+			return nil
+		})
+	})
+	if err == ctx.Err() {
+		return nil
+	}
+	return err
+}
+
+// tailCommand prints or saves the skins published to new_skins
+//
+//	skin-bot tail [-json] [-archive dir]
+func tailCommand(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("tail", flag.ContinueOnError)
+	print_json := flags.Bool("json", false, "print every skin as a line of json")
+	archive_dir := flags.String("archive", "", "save skins to this archive dir")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	client, err := connectQueue()
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	var sinks utils.MultiSink
+	if *print_json {
+		sinks = append(sinks, utils.NewJsonlSink(os.Stdout))
+	}
+	if *archive_dir != "" {
+		archive, err := utils.OpenArchive(utils.ArchiveConfig{Dir: *archive_dir})
+		if err != nil {
+			return err
+		}
+		sinks = append(sinks, archive)
+	}
+	defer sinks.Close()
+
+	err = client.WithQueue(func(q *utils.MQ) error {
+		for skin := range q.SubscribeSkins(ctx) {
+			if !*print_json {
+				fmt.Printf("%s %s %s %s\n", time.Unix(skin.Time, 0).Format(time.RFC3339), skin.ServerAddress, skin.Xuid, skin.Username)
+			}
+			if err := sinks.Send(ctx, skin); err != nil {
+				logrus.Warn(err)
+			}
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return utils.ErrQueueClosed
+	})
+	if err == ctx.Err() {
+		return nil
+	}
+	return err
+}
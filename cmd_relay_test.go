@@ -0,0 +1,26 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bedrockteam/skin-bot/utils"
+)
+
+func TestRelayDedupe(t *testing.T) {
+	dedupe := &relayDedupe{ttl: time.Hour, seen: make(map[string]relaySeen)}
+	skin := &utils.QueuedSkin{Xuid: "2535400000001", Skin: testSkin().Json()}
+
+	hash, ok, err := dedupe.isNew(skin)
+	if err != nil || !ok {
+		t.Fatalf("first skin: %v %v", ok, err)
+	}
+	// not published yet, so it is still new
+	if _, ok, _ := dedupe.isNew(skin); !ok {
+		t.Error("skin is a duplicate before it was published")
+	}
+	dedupe.remember(skin.Xuid, hash)
+	if _, ok, _ := dedupe.isNew(skin); ok {
+		t.Error("published skin is new again")
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/bedrockteam/skin-bot/utils"
+)
+
+// spoolCommand shows what is waiting in the spool
+//
+//	skin-bot spool inspect
+func spoolCommand(ctx context.Context, args []string) error {
+	if len(args) < 1 || args[0] != "inspect" {
+		return fmt.Errorf("usage: spool inspect")
+	}
+
+	config, err := readConfig()
+	if err != nil {
+		return err
+	}
+	if config.Sink.Spool.Dir == "" {
+		return fmt.Errorf("Sink.Spool.Dir undefined")
+	}
+	// read only, a running skin-bot may be using the spool
+	segments, ack_segment, ack_offset, err := utils.InspectSpool(config.Sink.Spool)
+	if err != nil {
+		return err
+	}
+	total := 0
+	for _, seg := range segments {
+		if seg.Size == 0 {
+			continue
+		}
+		state := "pending"
+		if seg.Acked {
+			state = "acked"
+		}
+		fmt.Printf("segment %d: %d bytes, %d pending, %s - %s, %s\n", seg.ID, seg.Size, seg.Pending,
+			seg.Oldest.Format(time.RFC3339), seg.Newest.Format(time.RFC3339), state)
+		total += seg.Pending
+	}
+	fmt.Printf("%d skins pending, acked up to segment %d offset %d\n", total, ack_segment, ack_offset)
+	return nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/bedrockteam/skin-bot/utils"
+)
+
+// commands that can be run instead of the bots, `skin-bot <command> [args]`
+var commands = map[string]func(ctx context.Context, args []string) error{
+	"schema":   schemaCommand,
+	"archive":  archiveCommand,
+	"capes":    capesCommand,
+	"persona":  personaCommand,
+	"spool":    spoolCommand,
+	"relay":    relayCommand,
+	"tail":     tailCommand,
+	"dlq":      dlqCommand,
+	"accounts": accountsCommand,
+}
+
+// schemaCommand prints the json schema of the published skins
+//
+//	skin-bot schema [version]
+func schemaCommand(ctx context.Context, args []string) error {
+	version := utils.SchemaVersion
+	if len(args) > 0 {
+		var err error
+		if version, err = strconv.Atoi(args[0]); err != nil {
+			return err
+		}
+	}
+	schema, err := utils.JsonSchema(version)
+	if err != nil {
+		return fmt.Errorf("no schema for version %d", version)
+	}
+	_, err = os.Stdout.Write(schema)
+	return err
+}
+
+// capesCommand lists the cape catalog, most worn first
+func capesCommand(ctx context.Context, args []string) error {
+	config, err := readConfig()
+	if err != nil {
+		return err
+	}
+	if config.Capes.File == "" {
+		return fmt.Errorf("Capes.File undefined")
+	}
+	capes, err := utils.OpenCapeCatalog(config.Capes)
+	if err != nil {
+		return err
+	}
+	defer capes.Close()
+
+	for _, cape := range capes.List() {
+		fmt.Printf("%6d %s %s %s\n", cape.Players, cape.FirstSeen.Format(time.RFC3339), cape.ID, cape.FirstServer)
+	}
+	return nil
+}
+
+// personaCommand exports the persona piece catalog
+//
+//	skin-bot persona [-format json|csv] [-server name] [-marketplace] [-tints]
+func personaCommand(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("persona", flag.ContinueOnError)
+	format := flags.String("format", "csv", "json or csv")
+	server := flags.String("server", "", "only this server")
+	marketplace := flags.Bool("marketplace", false, "only marketplace pieces")
+	tints := flags.Bool("tints", false, "export tints instead of pieces")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	config, err := readConfig()
+	if err != nil {
+		return err
+	}
+	if config.Persona.File == "" {
+		return fmt.Errorf("Persona.File undefined")
+	}
+	persona, err := utils.OpenPersonaCatalog(config.Persona)
+	if err != nil {
+		return err
+	}
+	defer persona.Close()
+
+	if *tints {
+		return persona.ExportTints(os.Stdout, *format, *server)
+	}
+	return persona.Export(os.Stdout, *format, *server, *marketplace)
+}
@@ -7,6 +7,7 @@ import (
 	"math/rand"
 	"os"
 	"os/signal"
+	"runtime/debug"
 	"strings"
 	"sync"
 	"syscall"
@@ -22,20 +23,95 @@ import (
 )
 
 type Config struct {
-	API struct {
-		Server string
-		Key    string
-	}
+	API     utils.APIConfig
 	Discord struct {
 		WebhookId    string
 		WebhookToken string
 	}
-	Users []struct {
-		Name    string
-		Address string
-	}
+	Queue           utils.QueueConfig
+	Sink            utils.SinkConfig
+	Archive         utils.ArchiveConfig
+	Capes           utils.CapeCatalogConfig
+	Persona         utils.PersonaCatalogConfig
+	Node            utils.NodeConfig
+	Assignments     utils.AssignmentConfig
+	Users           []UserConfig
 	ServerAddresses string
 	ServerBlacklist []string
+	// OfflineServers run with online-mode off, only they get bots with Offline accounts
+	OfflineServers []string
+}
+
+type UserConfig struct {
+	Name    string
+	Address string
+	// Offline connects without xbox auth, only to OfflineServers
+	Offline bool
+	// DisplayName is the in game name of an Offline user, defaults to Name
+	DisplayName string
+}
+
+func (u UserConfig) account() utils.Account {
+	return utils.Account{
+		Name:        u.Name,
+		Offline:     u.Offline,
+		DisplayName: u.DisplayName,
+	}
+}
+
+// withDefaultPort adds the default bedrock port to server if it has none
+func withDefaultPort(server string) string {
+	if !strings.Contains(server, ":") {
+		return server + ":19132"
+	}
+	return server
+}
+
+// isOfflineServer checks if server is in OfflineServers
+func (c *Config) isOfflineServer(server string) bool {
+	for _, s := range c.OfflineServers {
+		if withDefaultPort(s) == withDefaultPort(server) {
+			return true
+		}
+	}
+	return false
+}
+
+// usableUsers drops the users without a valid token, the bots never ask for a login
+func usableUsers(users []UserConfig) []UserConfig {
+	var usable []UserConfig
+	for _, user := range users {
+		if !user.Offline {
+			if _, err := utils.GetTokenSource(user.Name); err != nil {
+				logrus.Errorf("Not using %s: %s", user.Name, err)
+				continue
+			}
+		}
+		usable = append(usable, user)
+	}
+	return usable
+}
+
+// pickUser picks a random user that may join server.
+// Offline users only join OfflineServers and are preferred there
+func (c *Config) pickUser(server string) (UserConfig, bool) {
+	offline := c.isOfflineServer(server)
+	var online_users, offline_users []UserConfig
+	for _, user := range c.Users {
+		if user.Offline {
+			offline_users = append(offline_users, user)
+		} else {
+			online_users = append(online_users, user)
+		}
+	}
+	users := online_users
+	if offline && len(offline_users) > 0 {
+		users = offline_users
+	}
+	if len(users) == 0 {
+		return UserConfig{}, false
+	}
+	return users[rand.Intn(len(users))], true
 }
 
 // ip -> bot
@@ -45,6 +121,61 @@ var bots = make(map[string]*Bot)
 // ip -> time to retry
 var ip_waitlist = make(map[string]time.Time)
 
+// readConfig reads config.toml if it exists
+func readConfig() (*Config, error) {
+	var config Config
+	if _, err := os.Stat("config.toml"); err == nil {
+		if _, err := toml.DecodeFile("config.toml", &config); err != nil {
+			return nil, err
+		}
+	}
+	return &config, nil
+}
+
+// canStartBot checks that no bot is running on address and it is not on the waitlist
+func canStartBot(address string) bool {
+	bots_lock.Lock()
+	defer bots_lock.Unlock()
+	if w, ok := ip_waitlist[address]; ok {
+		if time.Now().Before(w) {
+			return false
+		}
+		delete(ip_waitlist, address)
+	}
+	_, running := bots[address]
+	return !running
+}
+
+// buildVersion is the vcs revision the binary was built from
+func buildVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	version := info.Main.Version
+	for _, setting := range info.Settings {
+		if setting.Key == "vcs.revision" {
+			version = setting.Value
+		}
+	}
+	return version
+}
+
+// nodeStatus is what the node heartbeats report
+func nodeStatus() utils.NodeStatus {
+	bots_lock.Lock()
+	defer bots_lock.Unlock()
+	running := make(map[string]int)
+	for _, b := range bots {
+		server, _, _ := strings.Cut(b.ServerName, " ")
+		running[server]++
+	}
+	return utils.NodeStatus{
+		RunningBots: running,
+		Waitlist:    len(ip_waitlist),
+	}
+}
+
 func main() {
 	logrus.SetLevel(logrus.DebugLevel)
 
@@ -61,32 +192,41 @@ func main() {
 		cancel()
 	}()
 
-	var config Config
-
-	{
-		if _, err := os.Stat("config.toml"); err == nil {
-			_, err := toml.DecodeFile("config.toml", &config)
-			if err != nil {
-				logrus.Fatal(err)
-			}
+	if flag.NArg() > 0 {
+		command, ok := commands[flag.Arg(0)]
+		if !ok {
+			logrus.Fatalf("Unknown command %s", flag.Arg(0))
+		}
+		if err := command(ctx, flag.Args()[1:]); err != nil {
+			logrus.Fatal(err)
 		}
+		return
+	}
+
+	config, err := readConfig()
+	if err != nil {
+		logrus.Fatal(err)
+	}
 
+	{
 		{ // save config
 			f, _ := os.Create("config.toml")
 			defer f.Close()
-			if err := toml.NewEncoder(f).Encode(&config); err != nil {
+			if err := toml.NewEncoder(f).Encode(config); err != nil {
 				logrus.Fatal(err)
 			}
 		}
 
-		if config.API.Server == "" {
-			logrus.Fatal("API.Server undefined")
-		}
-		if config.API.Key == "" {
+		if config.API.Server != "" && config.API.Key == "" {
 			logrus.Fatal("API.Key undefined")
 		}
+		if config.Assignments.Enabled && config.API.Server == "" {
+			logrus.Fatal("Assignments need API.Server")
+		}
 		if len(config.Users) == 0 {
 			logrus.Warn("No Users defined")
+		} else if config.Users = usableUsers(config.Users); len(config.Users) == 0 {
+			logrus.Fatal("No user has a valid token, run skin-bot accounts login <name>")
 		}
 
 		if config.Discord.WebhookId != "" {
@@ -105,28 +245,66 @@ func main() {
 		}
 	}
 
+	metrics := NewMetrics()
+	client, err := utils.NewClient(config.API, metrics, config.Queue)
+	if err != nil {
+		logrus.Fatal(err)
+	}
 	{ // setup api client
-		if err := utils.InitAPIClient(config.API.Server, config.API.Key, NewMetrics()); err != nil {
+		client.NodeId = getNodeId()
+		if config.Capes.File != "" {
+			capes, err := utils.OpenCapeCatalog(config.Capes)
+			if err != nil {
+				logrus.Fatal(err)
+			}
+			client.Capes = capes
+		}
+		if config.Persona.File != "" {
+			persona, err := utils.OpenPersonaCatalog(config.Persona)
+			if err != nil {
+				logrus.Fatal(err)
+			}
+			client.Persona = persona
+		}
+		if err := client.Start(false); err != nil {
 			logrus.Fatal(err)
 		}
-		if err := utils.APIClient.Start(false); err != nil {
+		if err := client.OpenSinks(config.Sink, config.Archive); err != nil {
 			logrus.Fatal(err)
 		}
+
+		var accounts []string
+		for _, user := range config.Users {
+			accounts = append(accounts, user.Name)
+		}
+		client.StartNode(config.Node, utils.NodeInfo{
+			Version:   buildVersion(),
+			Accounts:  accounts,
+			Servers:   strings.Fields(config.ServerAddresses),
+			StartedAt: time.Now().Unix(),
+		}, nodeStatus)
+	}
+	defer client.Close()
+
+	if config.Assignments.Enabled {
+		runAssignments(ctx, config, client, metrics)
+		return
 	}
-	defer utils.APIClient.Close()
 
 	// starting the bots
 	for {
 		servers := strings.Split(config.ServerAddresses, " ")
 
-		user := config.Users[rand.Intn(len(config.Users))]
 		for _, server := range servers {
 			if ctx.Err() != nil {
 				break
 			}
 
-			if !strings.Contains(server, ":") {
-				server = server + ":19132"
+			server = withDefaultPort(server)
+			user, ok := config.pickUser(server)
+			if !ok {
+				logrus.Warnf("No user may join %s", server)
+				continue
 			}
 			var IPs []string
 			var err error
@@ -149,18 +327,10 @@ func main() {
 			for _, ip := range IPs {
 				_address := ip + ":19132"
 
-				if w, ok := ip_waitlist[_address]; ok {
-					if time.Now().After(w) {
-						delete(ip_waitlist, _address)
-					} else {
-						continue
-					}
-				}
-
-				if _, ok := bots[_address]; ok {
+				if !canStartBot(_address) {
 					continue
 				}
-				b := NewBot(user.Name, _address, fmt.Sprintf("%s %s", server, ip))
+				b := NewBot(client, metrics, user.account(), _address, fmt.Sprintf("%s %s", server, ip))
 				go b.Start(ctx)
 				count += 1
 			}
@@ -169,7 +339,9 @@ func main() {
 				logrus.Infof("Started %d Bots as %s on %s", count, user.Name, server)
 				logrus.Infof("Instances: %d", len(maps.Keys(bots)))
 			}
+			bots_lock.Lock()
 			logrus.Infof("Waiting: %d", len(maps.Keys(ip_waitlist)))
+			bots_lock.Unlock()
 		}
 
 		select {
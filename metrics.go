@@ -5,6 +5,7 @@ import (
 	"math/rand"
 	"os"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -15,6 +16,9 @@ import (
 const metricNamespace = "skin_bot"
 
 type Metrics struct {
+	lock             sync.Mutex
+	stop             chan struct{}
+	url              string
 	Pusher           *push.Pusher
 	RunningBots      *prometheus.GaugeVec
 	DisconnectEvents *prometheus.GaugeVec
@@ -22,30 +26,61 @@ type Metrics struct {
 }
 
 func (m *Metrics) Delete() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.stop != nil {
+		close(m.stop)
+		m.stop = nil
+	}
 	if m.Pusher != nil {
 		m.Pusher.Delete()
 	}
 }
 
-func (m *Metrics) Start(url, user, password string) error {
-	m.Pusher = push.New(url, metricNamespace).
+// Start pushes to url along with collectors, calling it again switches to the new url and credentials
+func (m *Metrics) Start(url, user, password string, collectors []prometheus.Collector) error {
+	pusher := push.New(url, metricNamespace).
 		BasicAuth(user, password).
 		Grouping("node_id", getNodeId()).
 		Collector(m.RunningBots).
 		Collector(m.DisconnectEvents).
 		Collector(m.Deaths)
-	if err := m.Pusher.Push(); err != nil {
+	for _, c := range collectors {
+		pusher.Collector(c)
+	}
+	if err := pusher.Push(); err != nil {
 		return err
 	}
 
-	go func() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.stop != nil {
+		close(m.stop)
+	}
+	// the group on the old gateway would stay there forever, on the same one the push replaced it
+	if m.Pusher != nil && m.url != url {
+		if err := m.Pusher.Delete(); err != nil {
+			logrus.Warnf("Failed to delete metrics from the old gateway %s", err)
+		}
+	}
+	m.Pusher = pusher
+	m.url = url
+	m.stop = make(chan struct{})
+
+	go func(stop chan struct{}) {
 		t := time.NewTicker(15 * time.Second)
-		for range t.C {
-			if err := m.Pusher.Add(); err != nil {
-				logrus.Warnf("Failed to push metrics %s", err)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				if err := pusher.Add(); err != nil {
+					logrus.Warnf("Failed to push metrics %s", err)
+				}
+			case <-stop:
+				return
 			}
 		}
-	}()
+	}(m.stop)
 
 	return nil
 }
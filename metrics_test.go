@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+)
+
+// gateway records the methods of the requests to a fake pushgateway
+type gateway struct {
+	*httptest.Server
+	lock    sync.Mutex
+	methods []string
+}
+
+func newGateway(t *testing.T) *gateway {
+	g := &gateway{}
+	g.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		g.lock.Lock()
+		g.methods = append(g.methods, r.Method)
+		g.lock.Unlock()
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	t.Cleanup(g.Close)
+	return g
+}
+
+func (g *gateway) deletes() int {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	n := 0
+	for _, method := range g.methods {
+		if method == http.MethodDelete {
+			n++
+		}
+	}
+	return n
+}
+
+// switching gateways deletes the group from the old one, new credentials for the same one dont
+func TestMetricsRotate(t *testing.T) {
+	// getNodeId writes node_id.txt
+	wd, _ := os.Getwd()
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	old, current := newGateway(t), newGateway(t)
+	m := NewMetrics()
+	t.Cleanup(m.Delete)
+	if err := m.Start(old.URL, "user", "old", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Start(current.URL, "user", "old", nil); err != nil {
+		t.Fatal(err)
+	}
+	if n := old.deletes(); n != 1 {
+		t.Errorf("old gateway got %d deletes, wanted 1", n)
+	}
+	if err := m.Start(current.URL, "user", "new", nil); err != nil {
+		t.Fatal(err)
+	}
+	if n := current.deletes(); n != 0 {
+		t.Errorf("rotating the credentials deleted the group %d times", n)
+	}
+}
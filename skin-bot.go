@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/bedrockteam/skin-bot/utils"
@@ -22,10 +23,14 @@ type cachedPlayer struct {
 type Bot struct {
 	// Username is the username of this bot
 	Username string
+	account  utils.Account
 	// Address is the server address this bot will connect to
 	Address string
 	// ServerName is the readable name of the server
 	ServerName string
+	// client receives the skins this bot sees
+	client  *utils.Client
+	metrics *Metrics
 	// serverConn is the connection to the server
 	serverConn *minecraft.Conn
 	ctx        context.Context
@@ -37,11 +42,15 @@ type Bot struct {
 }
 
 // NewBot creates a new bot
-func NewBot(name, address, serverName string) *Bot {
+func NewBot(client *utils.Client, metrics *Metrics, account utils.Account, address, serverName string) *Bot {
+	name := account.Name
 	b := &Bot{
 		Username:   name,
+		account:    account,
 		Address:    address,
 		ServerName: serverName,
+		client:     client,
+		metrics:    metrics,
 		log: func() *logrus.Entry {
 			fields := logrus.Fields{
 				"Bot":     name,
@@ -71,8 +80,7 @@ func (b *Bot) Start(ctx context.Context) {
 		bots_lock.Unlock()
 	}()
 
-	metrics := utils.APIClient.Metrics.(*Metrics)
-
+	metrics := b.metrics
 	metrics.RunningBots.WithLabelValues(b.ServerName).Inc()
 	defer metrics.RunningBots.WithLabelValues(b.ServerName).Dec()
 
@@ -90,7 +98,9 @@ func (b *Bot) Start(ctx context.Context) {
 		if !b.spawned || shortRun {
 			metrics.Deaths.WithLabelValues(b.ServerName, b.Address).Inc()
 			b.log().Warn("Failed to fast, adding ip to waitlist for 15 minutes")
+			bots_lock.Lock()
 			ip_waitlist[b.Address] = time.Now().Add(15 * time.Minute)
+			bots_lock.Unlock()
 		}
 
 		if err != nil {
@@ -98,7 +108,10 @@ func (b *Bot) Start(ctx context.Context) {
 			metrics.DisconnectEvents.WithLabelValues(b.ServerName, b.Address).Inc()
 		}
 
-		time.Sleep(30 * time.Second)
+		select {
+		case <-time.After(30 * time.Second):
+		case <-ctx.Done():
+		}
 	}
 }
 
@@ -108,12 +121,23 @@ func (b *Bot) do() (err error) {
 	b.players = make(map[uuid.UUID]cachedPlayer)
 
 	// connect
-	b.serverConn, err = utils.ConnectServer(b.ctx, b.Address, b.Username, nil)
+	b.serverConn, err = utils.ConnectServer(b.ctx, b.Address, b.account, nil)
 	if err != nil {
 		return fmt.Errorf("failed to connect to server %s", err)
 	}
 	defer b.serverConn.Close()
 
+	// ReadPacket only returns at its deadline, a bot whose lease ended has to leave right away
+	stopped := make(chan struct{})
+	defer close(stopped)
+	go func(conn *minecraft.Conn) {
+		select {
+		case <-b.ctx.Done():
+			conn.Close()
+		case <-stopped:
+		}
+	}(b.serverConn)
+
 	// spawn
 	if err := b.serverConn.DoSpawnContext(b.ctx); err != nil {
 		return fmt.Errorf("failed to spawn: %s", err)
@@ -166,7 +190,7 @@ func (b *Bot) processSkinsPacket(pk packet.Packet) {
 func (b *Bot) maybeSubmitPlayer(player cachedPlayer, skin *utils.Skin) {
 	b.players[player.uuid] = player
 
-	if player.xuid == b.serverConn.IdentityData().XUID {
+	if b.serverConn != nil && player.xuid == b.serverConn.IdentityData().XUID {
 		return
 	}
 
@@ -175,5 +199,6 @@ func (b *Bot) maybeSubmitPlayer(player cachedPlayer, skin *utils.Skin) {
 		return
 	}
 
-	utils.APIClient.UploadSkin(context.Background(), skin, username, player.xuid, b.ServerName)
+	ip, _, _ := strings.Cut(b.Address, ":")
+	b.client.UploadSkin(context.Background(), skin, username, player.xuid, b.ServerName, b.Username, ip)
 }
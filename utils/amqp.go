@@ -0,0 +1,48 @@
+package utils
+
+import (
+	"context"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// AMQPChannel is the part of an amqp channel the queue uses, *amqp.Channel implements it
+type AMQPChannel interface {
+	Qos(prefetchCount, prefetchSize int, global bool) error
+	QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error)
+	QueueBind(name, key, exchange string, noWait bool, args amqp.Table) error
+	ExchangeDeclare(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error
+	Confirm(noWait bool) error
+	NotifyPublish(confirm chan amqp.Confirmation) chan amqp.Confirmation
+	NotifyClose(c chan *amqp.Error) chan *amqp.Error
+	GetNextPublishSeqNo() uint64
+	PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error
+	Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error)
+	Get(queue string, autoAck bool) (amqp.Delivery, bool, error)
+	Nack(tag uint64, multiple, requeue bool) error
+	Close() error
+}
+
+// AMQPConnection is the part of an amqp connection the queue uses
+type AMQPConnection interface {
+	Channel() (AMQPChannel, error)
+	NotifyClose(c chan *amqp.Error) chan *amqp.Error
+	IsClosed() bool
+	Close() error
+}
+
+// AMQPDialer connects to the broker at uri, ctx aborts the dial
+type AMQPDialer func(ctx context.Context, uri string) (AMQPConnection, error)
+
+// amqpConnection is an AMQPConnection to a real broker
+type amqpConnection struct {
+	*amqp.Connection
+}
+
+func (c amqpConnection) Channel() (AMQPChannel, error) {
+	ch, err := c.Connection.Channel()
+	if err != nil {
+		return nil, err
+	}
+	return ch, nil
+}
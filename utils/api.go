@@ -1,124 +1,273 @@
 package utils
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
-	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sirupsen/logrus"
 )
 
 type Metrics interface {
-	// Start starts the metric pusher
-	Start(url, user, password string) error
+	// Start starts the metric pusher, collectors are the metrics of the client
+	Start(url, user, password string, collectors []prometheus.Collector) error
 	// deletes from pusher
 	Delete()
 }
 
-type Queue interface {
-	Start(url string) error
-}
+// Client talks to one api server and sends skins to the sinks, a process can have several
+type Client struct {
+	config      APIConfig
+	client      *http.Client
+	queueConfig QueueConfig
+	want_pubsub bool
 
-type APIRoutes struct {
-	AMQPUrl           string
-	PrometheusPushURL string
-	PrometheusAuth    string
-}
+	lock  sync.Mutex
+	queue *MQ
+	etag  string
 
-type apiClient struct {
-	server string
-	key    string
+	stop_refresh context.CancelFunc
+	refresh_done chan struct{}
 
-	client *http.Client
+	node        *node
+	assignments *Assignments
+	stats       *clientMetrics
 
-	Queue   *MQ
+	Sink    Sink
+	Capes   *CapeCatalog
+	Persona *PersonaCatalog
 	Metrics Metrics
 	Routes  *APIRoutes
-}
+	// NodeId identifies this skin-bot in the published skins, set it before Start
+	NodeId string
 
-var APIClient *apiClient
+	// Uploads counts the skins passed to UploadSkin, UploadErrors the ones the sinks failed to take or the api server rejected
+	Uploads      atomic.Int64
+	UploadErrors atomic.Int64
+}
 
-// InitAPIClient creates the api client
-func InitAPIClient(APIServer, APIKey string, metrics Metrics) error {
-	APIClient = &apiClient{
-		server:  APIServer,
-		key:     APIKey,
-		client:  &http.Client{},
-		Metrics: metrics,
-		Routes:  nil,
+// NewClient creates a client, Start connects it
+func NewClient(config APIConfig, metrics Metrics, queueConfig QueueConfig) (*Client, error) {
+	if _, err := (MessageEncoding{queueConfig.Encoding, queueConfig.Compression}).ContentType(); err != nil {
+		return nil, err
 	}
-	return nil
+	if err := queueConfig.Topology.setDefaults(); err != nil {
+		return nil, err
+	}
+	if _, err := newMessageSigner(queueConfig.Signing); err != nil {
+		return nil, err
+	}
+	if config.RoutesRefresh == 0 {
+		config.RoutesRefresh = 5 * time.Minute
+	}
+	if config.RoutesCache == "" {
+		config.RoutesCache = "routes.json"
+	}
+	if config.Timeout == 0 {
+		config.Timeout = 1 * time.Minute
+	}
+	if config.ConnectTimeout == 0 {
+		config.ConnectTimeout = 10 * time.Second
+	}
+	switch {
+	case config.StartRetries == 0:
+		config.StartRetries = 5
+	case config.StartRetries < 0:
+		config.StartRetries = 0
+	}
+	client, err := newHTTPClient(config)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{
+		config:      config,
+		client:      client,
+		queueConfig: queueConfig,
+		Metrics:     metrics,
+		Routes:      nil,
+		stats:       newClientMetrics(),
+	}, nil
 }
 
-func (u *apiClient) doRequest(req *http.Request) (resp *http.Response, err error) {
-	req.Header.Set("Authorization", u.key)
+func (u *Client) doRequest(req *http.Request) (resp *http.Response, err error) {
+	if u.config.SignRequests {
+		if err := signRequest(req, u.config.KeyId, []byte(u.config.Key)); err != nil {
+			return nil, err
+		}
+	} else {
+		req.Header.Set("Authorization", u.config.Key)
+	}
 	return u.client.Do(req)
 }
 
-// Start starts the api client
-func (u *apiClient) Start(want_pubsub bool) error {
-	if u.Routes == nil {
-		req, _ := http.NewRequest("GET", APIClient.server+"/routes", nil)
-		resp, err := APIClient.doRequest(req)
-		if err != nil {
-			return err
-		}
+// apiStatusError is a non 2xx response of the api server
+type apiStatusError struct {
+	status int
+}
 
-		if resp.StatusCode != 200 {
-			return fmt.Errorf("API StatusCode: %d", resp.StatusCode)
-		}
+func (e *apiStatusError) Error() string {
+	return fmt.Sprintf("API StatusCode: %d", e.status)
+}
 
-		u.Routes = &APIRoutes{}
-		if err := json.NewDecoder(resp.Body).Decode(u.Routes); err != nil {
+// jsonRequest sends body as json to path on the api server and decodes the response to out if its not nil
+func (u *Client) jsonRequest(ctx context.Context, method, path string, body, out any) error {
+	var r io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
 			return err
 		}
+		r = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u.config.Server+path, r)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := u.doRequest(req)
+	if err != nil {
+		return err
 	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		io.Copy(io.Discard, resp.Body)
+		return &apiStatusError{resp.StatusCode}
+	}
+	if out == nil {
+		io.Copy(io.Discard, resp.Body)
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
 
-	// rabbitmq
-	if u.Routes.AMQPUrl != "" {
-		u.Queue = NewQueue(u.Routes.AMQPUrl, want_pubsub)
-		err := <-u.Queue.inital_connect_err
-		if err != nil {
-			logrus.Fatal(err)
-		}
+// Start fetches the routes, connects to them and keeps them up to date.
+// with StartDegraded it only fails on bad config, what is unreachable is retried in the background
+func (u *Client) Start(want_pubsub bool) error {
+	if u.config.Server == "" {
+		logrus.Info("No API server configured")
+		return nil
 	}
+	u.want_pubsub = want_pubsub
 
-	// prometheus
-	if u.Metrics != nil && u.Routes.PrometheusPushURL != "" {
-		auth := strings.Split(u.Routes.PrometheusAuth, ":")
-		if err := u.Metrics.Start(u.Routes.PrometheusPushURL, auth[0], auth[1]); err != nil {
+	if u.Routes == nil {
+		routes, etag, err := u.initialRoutes(context.Background())
+		switch {
+		case err == nil:
+			u.Routes, u.etag = routes, etag
+		case u.config.StartDegraded:
+			logrus.Warnf("%s, starting degraded until the API server is reachable", err)
+		default:
 			return err
 		}
 	}
+	if u.Routes != nil {
+		if err := u.applyRoutes(nil, u.Routes); err != nil {
+			if !u.config.StartDegraded {
+				return err
+			}
+			logrus.Warnf("%s, starting degraded", err)
+			// the next refresh applies the routes again
+			u.Routes, u.etag = nil, ""
+		}
+	}
 
+	ctx, cancel := context.WithCancel(context.Background())
+	u.stop_refresh = cancel
+	u.refresh_done = make(chan struct{})
+	go u.refreshRoutes(ctx)
 	return nil
 }
 
-var c = 0
+// Queue returns the current queue, nil if there is none. it changes when the routes change.
+func (u *Client) Queue() *MQ {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	return u.queue
+}
 
-// UploadSkin pushes a skin to the message server
-func (u *apiClient) UploadSkin(ctx context.Context, skin *Skin, username, xuid string, serverAddress string) {
-	c += 1
-	logrus.Infof("Uploading Skin %s %s %d", serverAddress, username, c)
+// WithQueue calls f with the current queue, again with the new one if the queue was swapped during f.
+// f should return ErrQueueClosed when the queue it got was closed
+func (u *Client) WithQueue(f func(q *MQ) error) error {
+	for {
+		q := u.Queue()
+		if q == nil {
+			return fmt.Errorf("no queue")
+		}
+		err := f(q)
+		if errors.Is(err, ErrQueueClosed) && u.Queue() != q {
+			continue
+		}
+		return err
+	}
+}
 
-	err := u.Queue.PublishSkin(ctx, &QueuedSkin{
-		username,
-		xuid,
-		skin.Json(),
-		serverAddress,
-		time.Now().Unix(),
-	})
-	if err != nil {
+// UploadSkin sends a skin to the sinks, account is the bot that saw it on the server instance ip
+func (u *Client) UploadSkin(ctx context.Context, skin *Skin, username, xuid string, serverAddress, account, ip string) {
+	count := u.Uploads.Add(1)
+	logrus.Infof("Uploading Skin %s %s %d", serverAddress, username, count)
+
+	queued_skin := &QueuedSkin{
+		Version:       SchemaVersion,
+		Username:      username,
+		Xuid:          xuid,
+		Skin:          skin.Json(),
+		ServerAddress: serverAddress,
+		Time:          time.Now().Unix(),
+		Message: &MessageInfo{
+			Account: account,
+			IP:      ip,
+		},
+	}
+
+	if u.Persona != nil {
+		u.Persona.Record(queued_skin)
+	}
+	if u.Capes != nil {
+		u.Capes.Reference(queued_skin)
+	}
+
+	if err := u.Sink.Send(ctx, queued_skin); err != nil {
+		u.UploadErrors.Add(1)
 		logrus.Warn(err)
 	}
 }
 
-func (u *apiClient) Close() {
+func (u *Client) Close() {
 	logrus.Debug("Closing API Client")
-	u.Queue.Close()
+	if u.Sink != nil {
+		if err := u.Sink.Close(); err != nil {
+			logrus.Warn(err)
+		}
+	}
+	if u.assignments != nil {
+		u.assignments.close()
+	}
+	if u.node != nil {
+		u.node.close()
+	}
+	if u.stop_refresh != nil {
+		u.stop_refresh()
+		<-u.refresh_done
+	}
+	if q := u.Queue(); q != nil {
+		q.Close()
+	}
+	if u.Capes != nil {
+		u.Capes.Close()
+	}
+	if u.Persona != nil {
+		u.Persona.Close()
+	}
 	if u.Metrics != nil {
 		u.Metrics.Delete()
 	}
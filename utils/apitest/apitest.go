@@ -0,0 +1,359 @@
+// Package apitest has stand-ins for the api server and the amqp broker so the upload pipeline can run in go test
+package apitest
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bedrockteam/skin-bot/utils"
+)
+
+// recorder keeps the skins that arrived and wakes up everyone waiting for them
+type recorder struct {
+	lock    sync.Mutex
+	skins   []*utils.QueuedSkin
+	changed chan struct{}
+}
+
+func (r *recorder) record(skins ...*utils.QueuedSkin) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.skins = append(r.skins, skins...)
+	if r.changed != nil {
+		close(r.changed)
+		r.changed = nil
+	}
+}
+
+// Skins returns the skins received so far
+func (r *recorder) Skins() []*utils.QueuedSkin {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return append([]*utils.QueuedSkin(nil), r.skins...)
+}
+
+// WaitSkins waits until at least n skins were received
+func (r *recorder) WaitSkins(n int, timeout time.Duration) ([]*utils.QueuedSkin, error) {
+	deadline := time.After(timeout)
+	for {
+		r.lock.Lock()
+		if len(r.skins) >= n {
+			skins := append([]*utils.QueuedSkin(nil), r.skins...)
+			r.lock.Unlock()
+			return skins, nil
+		}
+		if r.changed == nil {
+			r.changed = make(chan struct{})
+		}
+		changed, have := r.changed, len(r.skins)
+		r.lock.Unlock()
+
+		select {
+		case <-changed:
+		case <-deadline:
+			return nil, fmt.Errorf("got %d skins, wanted %d", have, n)
+		}
+	}
+}
+
+// Server is a fake api server, it serves /routes, takes uploads and keeps track of nodes and their leases
+type Server struct {
+	*httptest.Server
+	recorder
+	Key string
+
+	cache_dir string
+
+	lock          sync.Mutex
+	routes        utils.APIRoutes
+	routes_status int
+	routes_gets   int
+	upload_status int
+	rejected      map[string]bool
+	nodes         map[string]utils.NodeInfo
+	heartbeats    map[string]utils.NodeStatus
+	assignments   []utils.Assignment
+	nonces        map[string]time.Time
+}
+
+// NewServer starts a fake api server that accepts key, its routes only have an UploadURL
+func NewServer(key string) *Server {
+	s := &Server{
+		Key:        key,
+		routes:     utils.APIRoutes{UploadURL: "/upload"},
+		nodes:      make(map[string]utils.NodeInfo),
+		heartbeats: make(map[string]utils.NodeStatus),
+		nonces:     make(map[string]time.Time),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/routes", s.handleRoutes)
+	mux.HandleFunc("/upload", s.handleUpload)
+	mux.HandleFunc("/nodes", s.handleNodes)
+	mux.HandleFunc("/nodes/", s.handleNodes)
+	s.Server = httptest.NewServer(s.authorized(mux))
+	return s
+}
+
+// Config is an APIConfig for this server, its routes cache is in a temporary dir
+func (s *Server) Config() utils.APIConfig {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.cache_dir == "" {
+		dir, err := os.MkdirTemp("", "apitest")
+		if err != nil {
+			panic(err)
+		}
+		s.cache_dir = dir
+	}
+	return utils.APIConfig{
+		Server:      s.URL,
+		Key:         s.Key,
+		RoutesCache: filepath.Join(s.cache_dir, "routes.json"),
+	}
+}
+
+// Close stops the server and removes the routes cache
+func (s *Server) Close() {
+	s.Server.Close()
+	if s.cache_dir != "" {
+		os.RemoveAll(s.cache_dir)
+	}
+}
+
+// SetRoutes changes what /routes returns, relative urls are kept as they are
+func (s *Server) SetRoutes(routes utils.APIRoutes) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.routes = routes
+}
+
+// SetRoutesStatus makes /routes fail with status, 0 serves the routes again
+func (s *Server) SetRoutesStatus(status int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.routes_status = status
+}
+
+// RoutesRequests is how often /routes was requested
+func (s *Server) RoutesRequests() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.routes_gets
+}
+
+// SetUploadStatus makes uploads fail with status, 0 accepts them again
+func (s *Server) SetUploadStatus(status int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.upload_status = status
+}
+
+// RejectSkinsOf makes uploads with a skin of username fail with 422, like a skin the server cant take
+func (s *Server) RejectSkinsOf(username string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.rejected == nil {
+		s.rejected = make(map[string]bool)
+	}
+	s.rejected[username] = true
+}
+
+// SetAssignments sets the leases every node gets
+func (s *Server) SetAssignments(assignments []utils.Assignment) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.assignments = assignments
+}
+
+// Nodes returns the registered nodes
+func (s *Server) Nodes() map[string]utils.NodeInfo {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	nodes := make(map[string]utils.NodeInfo, len(s.nodes))
+	for id, info := range s.nodes {
+		nodes[id] = info
+	}
+	return nodes
+}
+
+// Heartbeat returns the last status a node sent
+func (s *Server) Heartbeat(node_id string) (utils.NodeStatus, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	status, ok := s.heartbeats[node_id]
+	return status, ok
+}
+
+// ForgetNode drops a node like an api server that restarted, its next heartbeat gets a 404
+func (s *Server) ForgetNode(node_id string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.nodes, node_id)
+	delete(s.heartbeats, node_id)
+}
+
+// maxSkew is how old a signed request may be
+const maxSkew = 5 * time.Minute
+
+// authorized accepts requests with the key in Authorization or signed with it
+func (s *Server) authorized(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") == s.Key {
+			next.ServeHTTP(w, r)
+			return
+		}
+		nonce, err := utils.VerifyRequest(r, []byte(s.Key), maxSkew)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		if !s.useNonce(nonce) {
+			http.Error(w, "replayed request", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// useNonce remembers nonce, false if it was used before
+func (s *Server) useNonce(nonce string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	now := time.Now()
+	for n, t := range s.nonces {
+		if now.Sub(t) > 2*maxSkew {
+			delete(s.nonces, n)
+		}
+	}
+	if _, ok := s.nonces[nonce]; ok {
+		return false
+	}
+	s.nonces[nonce] = now
+	return true
+}
+
+func (s *Server) handleRoutes(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	s.routes_gets++
+	status := s.routes_status
+	data, err := json.Marshal(s.routes)
+	s.lock.Unlock()
+	if status != 0 {
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sum := sha256.Sum256(data)
+	etag := `"` + hex.EncodeToString(sum[:8]) + `"`
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+func (s *Server) handleUpload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	s.lock.Lock()
+	status := s.upload_status
+	s.lock.Unlock()
+	if status != 0 {
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	skins, err := utils.DecodeSkins(r.Header.Get("Content-Type"), body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.lock.Lock()
+	for _, skin := range skins {
+		if s.rejected[skin.Username] {
+			s.lock.Unlock()
+			http.Error(w, "rejected skin of "+skin.Username, http.StatusUnprocessableEntity)
+			return
+		}
+	}
+	s.lock.Unlock()
+	s.record(skins...)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleNodes serves /nodes, /nodes/{id}, /nodes/{id}/heartbeat and /nodes/{id}/assignments
+func (s *Server) handleNodes(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/nodes"), "/")
+	node_id, action, _ := strings.Cut(path, "/")
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	switch {
+	case node_id == "" && r.Method == "POST":
+		var info utils.NodeInfo
+		if err := json.NewDecoder(r.Body).Decode(&info); err != nil || info.NodeId == "" {
+			http.Error(w, "bad node", http.StatusBadRequest)
+			return
+		}
+		s.nodes[info.NodeId] = info
+		w.WriteHeader(http.StatusNoContent)
+		return
+	case node_id == "":
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if _, ok := s.nodes[node_id]; !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch {
+	case action == "" && r.Method == "DELETE":
+		delete(s.nodes, node_id)
+		delete(s.heartbeats, node_id)
+		w.WriteHeader(http.StatusNoContent)
+	case action == "heartbeat" && r.Method == "POST":
+		var status utils.NodeStatus
+		if err := json.NewDecoder(r.Body).Decode(&status); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.heartbeats[node_id] = status
+		w.WriteHeader(http.StatusNoContent)
+	case action == "assignments" && r.Method == "POST":
+		var resp struct {
+			Assignments []utils.Assignment
+		}
+		resp.Assignments = s.assignments
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	case action == "assignments" && r.Method == "DELETE":
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.NotFound(w, r)
+	}
+}
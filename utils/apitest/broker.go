@@ -0,0 +1,823 @@
+package apitest
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bedrockteam/skin-bot/utils"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Published is a message the broker accepted
+type Published struct {
+	Exchange   string
+	RoutingKey string
+	Publishing amqp.Publishing
+}
+
+type brokerMessage struct {
+	exchange    string
+	key         string
+	publishing  amqp.Publishing
+	redelivered bool
+}
+
+type brokerQueue struct {
+	name     string
+	args     amqp.Table
+	messages []brokerMessage
+	// exclusive queues are deleted with the connection that declared them
+	owner *brokerConn
+}
+
+type brokerBinding struct {
+	queue string
+	key   string
+}
+
+type brokerExchange struct {
+	kind     string
+	bindings []brokerBinding
+}
+
+// Broker is an in memory amqp broker with queues, direct, fanout and topic exchanges, publisher confirms and acks.
+// set Dial as QueueConfig.Dial to connect queues to it. the skins of every accepted message are recorded.
+type Broker struct {
+	recorder
+
+	lock       sync.Mutex
+	cond       *sync.Cond
+	queues     map[string]*brokerQueue
+	exchanges  map[string]*brokerExchange
+	conns      map[*brokerConn]bool
+	published  []Published
+	changed    chan struct{}
+	next_queue int
+
+	messages      int
+	bytes         int64
+	discard       bool
+	dials         int
+	dial_err      error
+	dial_blocked  chan struct{}
+	nack_next     int
+	drop_confirms bool
+}
+
+// NewBroker creates an empty broker
+func NewBroker() *Broker {
+	b := &Broker{
+		queues:    make(map[string]*brokerQueue),
+		exchanges: make(map[string]*brokerExchange),
+		conns:     make(map[*brokerConn]bool),
+	}
+	b.cond = sync.NewCond(&b.lock)
+	return b
+}
+
+// Dial implements utils.AMQPDialer
+func (b *Broker) Dial(ctx context.Context, uri string) (utils.AMQPConnection, error) {
+	b.lock.Lock()
+	b.dials++
+	for b.dial_blocked != nil {
+		blocked := b.dial_blocked
+		b.lock.Unlock()
+		select {
+		case <-blocked:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		b.lock.Lock()
+	}
+	defer b.lock.Unlock()
+	if b.dial_err != nil {
+		return nil, b.dial_err
+	}
+	conn := &brokerConn{broker: b, channels: make(map[*brokerChannel]bool)}
+	b.conns[conn] = true
+	return conn, nil
+}
+
+// Dials is how often Dial was called
+func (b *Broker) Dials() int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.dials
+}
+
+// SetDialError makes dials fail with err, nil lets them through again
+func (b *Broker) SetDialError(err error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.dial_err = err
+}
+
+// BlockDial makes dials hang until they are unblocked or their ctx is done
+func (b *Broker) BlockDial(block bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	switch {
+	case block && b.dial_blocked == nil:
+		b.dial_blocked = make(chan struct{})
+	case !block && b.dial_blocked != nil:
+		close(b.dial_blocked)
+		b.dial_blocked = nil
+	}
+}
+
+// NackNext nacks the next n publishes instead of accepting them
+func (b *Broker) NackNext(n int) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.nack_next = n
+}
+
+// DropConfirms stops sending publisher confirms, the messages are still accepted
+func (b *Broker) DropConfirms(drop bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.drop_confirms = drop
+}
+
+// Discard makes the broker confirm messages without keeping or decoding them, Stats still counts them
+func (b *Broker) Discard(discard bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.discard = discard
+}
+
+// Stats returns how many messages and body bytes the broker accepted
+func (b *Broker) Stats() (messages int, bytes int64) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.messages, b.bytes
+}
+
+// DropConnections closes every connection like a broker restart would
+func (b *Broker) DropConnections() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for conn := range b.conns {
+		conn.close(&amqp.Error{Code: amqp.ConnectionForced, Reason: "CONNECTION_FORCED - broker forced connection closure", Server: true})
+	}
+}
+
+// CloseChannels closes every channel but keeps the connections open
+func (b *Broker) CloseChannels() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for conn := range b.conns {
+		for ch := range conn.channels {
+			ch.close(&amqp.Error{Code: amqp.PreconditionFailed, Reason: "PRECONDITION_FAILED - closed by the test", Server: true})
+		}
+	}
+}
+
+// Connections is the number of open connections
+func (b *Broker) Connections() int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return len(b.conns)
+}
+
+// Published returns the messages the broker accepted so far
+func (b *Broker) Published() []Published {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return append([]Published(nil), b.published...)
+}
+
+// WaitPublished waits until at least n messages were accepted
+func (b *Broker) WaitPublished(n int, timeout time.Duration) ([]Published, error) {
+	deadline := time.After(timeout)
+	for {
+		b.lock.Lock()
+		if len(b.published) >= n {
+			published := append([]Published(nil), b.published...)
+			b.lock.Unlock()
+			return published, nil
+		}
+		if b.changed == nil {
+			b.changed = make(chan struct{})
+		}
+		changed, have := b.changed, len(b.published)
+		b.lock.Unlock()
+
+		select {
+		case <-changed:
+		case <-deadline:
+			return nil, fmt.Errorf("got %d messages, wanted %d", have, n)
+		}
+	}
+}
+
+// Len is the number of ready messages in queue
+func (b *Broker) Len(queue string) int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if q, ok := b.queues[queue]; ok {
+		return len(q.messages)
+	}
+	return 0
+}
+
+// QueueArgs are the arguments queue was declared with
+func (b *Broker) QueueArgs(queue string) amqp.Table {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if q, ok := b.queues[queue]; ok {
+		return q.args
+	}
+	return nil
+}
+
+// Unacked is the number of delivered messages that were not acked yet
+func (b *Broker) Unacked() int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	n := 0
+	for conn := range b.conns {
+		for ch := range conn.channels {
+			n += len(ch.unacked)
+		}
+	}
+	return n
+}
+
+// Publish puts a message on the broker like a client would, for messages the queue would not publish itself
+func (b *Broker) Publish(exchange, key string, publishing amqp.Publishing) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.route(exchange, key, publishing)
+}
+
+// route delivers a message to the queues exchange routes it to, must hold lock
+func (b *Broker) route(exchange, key string, publishing amqp.Publishing) error {
+	b.messages++
+	b.bytes += int64(len(publishing.Body))
+	if b.discard {
+		return nil
+	}
+	headers := amqp.Table{}
+	for k, v := range publishing.Headers {
+		headers[k] = v
+	}
+	publishing.Headers = headers
+	publishing.Body = append([]byte(nil), publishing.Body...)
+
+	var queues []string
+	if exchange == "" {
+		queues = append(queues, key)
+	} else {
+		e, ok := b.exchanges[exchange]
+		if !ok {
+			return &amqp.Error{Code: amqp.NotFound, Reason: fmt.Sprintf("NOT_FOUND - no exchange '%s'", exchange)}
+		}
+		for _, binding := range e.bindings {
+			if e.kind == "fanout" || (e.kind == "direct" && binding.key == key) || (e.kind == "topic" && topicMatch(binding.key, key)) {
+				queues = append(queues, binding.queue)
+			}
+		}
+	}
+	for _, name := range queues {
+		if q, ok := b.queues[name]; ok {
+			q.messages = append(q.messages, brokerMessage{exchange: exchange, key: key, publishing: publishing})
+		}
+	}
+
+	b.published = append(b.published, Published{exchange, key, publishing})
+	if b.changed != nil {
+		close(b.changed)
+		b.changed = nil
+	}
+	if _, encrypted := publishing.Headers["x-skin-bot-encrypted"]; !encrypted {
+		if skins, err := utils.DecodeSkins(publishing.ContentType, publishing.Body); err == nil {
+			b.record(skins...)
+		}
+	}
+	b.cond.Broadcast()
+	return nil
+}
+
+// topicMatch matches a routing key against a binding key with * and # words
+func topicMatch(pattern, key string) bool {
+	return matchWords(strings.Split(pattern, "."), strings.Split(key, "."))
+}
+
+func matchWords(pattern, key []string) bool {
+	if len(pattern) == 0 {
+		return len(key) == 0
+	}
+	switch pattern[0] {
+	case "#":
+		for i := 0; i <= len(key); i++ {
+			if matchWords(pattern[1:], key[i:]) {
+				return true
+			}
+		}
+		return false
+	case "*":
+		return len(key) > 0 && matchWords(pattern[1:], key[1:])
+	}
+	return len(key) > 0 && pattern[0] == key[0] && matchWords(pattern[1:], key[1:])
+}
+
+// requeue puts messages back at the front of their queues in delivery order, must hold lock
+func (b *Broker) requeue(unacked map[uint64]unackedMessage, tags []uint64) {
+	sort.Slice(tags, func(i, j int) bool { return tags[i] > tags[j] })
+	for _, tag := range tags {
+		m := unacked[tag]
+		delete(unacked, tag)
+		if q, ok := b.queues[m.queue]; ok {
+			m.message.redelivered = true
+			q.messages = append([]brokerMessage{m.message}, q.messages...)
+		}
+	}
+	b.cond.Broadcast()
+}
+
+// brokerConn is a connection to the Broker
+type brokerConn struct {
+	broker   *Broker
+	closed   bool
+	notify   []chan *amqp.Error
+	channels map[*brokerChannel]bool
+}
+
+func (c *brokerConn) Channel() (utils.AMQPChannel, error) {
+	b := c.broker
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if c.closed {
+		return nil, amqp.ErrClosed
+	}
+	ch := &brokerChannel{
+		conn:     c,
+		next_tag: 1,
+		unacked:  make(map[uint64]unackedMessage),
+	}
+	c.channels[ch] = true
+	return ch, nil
+}
+
+func (c *brokerConn) NotifyClose(receiver chan *amqp.Error) chan *amqp.Error {
+	b := c.broker
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if c.closed {
+		close(receiver)
+	} else {
+		c.notify = append(c.notify, receiver)
+	}
+	return receiver
+}
+
+func (c *brokerConn) IsClosed() bool {
+	b := c.broker
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return c.closed
+}
+
+func (c *brokerConn) Close() error {
+	b := c.broker
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if c.closed {
+		return amqp.ErrClosed
+	}
+	c.close(nil)
+	return nil
+}
+
+// close closes the connection and its channels, err is nil for a close by the client, must hold lock
+func (c *brokerConn) close(err *amqp.Error) {
+	if c.closed {
+		return
+	}
+	c.closed = true
+	for ch := range c.channels {
+		ch.close(err)
+	}
+	for name, q := range c.broker.queues {
+		if q.owner == c {
+			delete(c.broker.queues, name)
+		}
+	}
+	for _, receiver := range c.notify {
+		if err != nil {
+			select {
+			case receiver <- err:
+			default:
+			}
+		}
+		close(receiver)
+	}
+	c.notify = nil
+	delete(c.broker.conns, c)
+}
+
+type unackedMessage struct {
+	queue   string
+	message brokerMessage
+}
+
+// brokerChannel is a channel on a brokerConn, it acks the deliveries it hands out
+type brokerChannel struct {
+	conn     *brokerConn
+	closed   bool
+	confirm  bool
+	next_tag uint64
+	confirms []chan amqp.Confirmation
+	notify   []chan *amqp.Error
+
+	delivery_tag uint64
+	unacked      map[uint64]unackedMessage
+	consumers    []*brokerConsumer
+}
+
+func (ch *brokerChannel) broker() *Broker {
+	return ch.conn.broker
+}
+
+// close closes the channel, requeueing what was not acked, must hold lock
+func (ch *brokerChannel) close(err *amqp.Error) {
+	if ch.closed {
+		return
+	}
+	ch.closed = true
+	for _, c := range ch.consumers {
+		c.cancel()
+	}
+	tags := make([]uint64, 0, len(ch.unacked))
+	for tag := range ch.unacked {
+		tags = append(tags, tag)
+	}
+	ch.broker().requeue(ch.unacked, tags)
+	for _, c := range ch.confirms {
+		close(c)
+	}
+	ch.confirms = nil
+	for _, receiver := range ch.notify {
+		if err != nil {
+			select {
+			case receiver <- err:
+			default:
+			}
+		}
+		close(receiver)
+	}
+	ch.notify = nil
+	delete(ch.conn.channels, ch)
+}
+
+func (ch *brokerChannel) Close() error {
+	b := ch.broker()
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	ch.close(nil)
+	return nil
+}
+
+func (ch *brokerChannel) Qos(prefetchCount, prefetchSize int, global bool) error {
+	return ch.check()
+}
+
+// check fails if the channel is closed
+func (ch *brokerChannel) check() error {
+	b := ch.broker()
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	return nil
+}
+
+func (ch *brokerChannel) QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error) {
+	b := ch.broker()
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if ch.closed {
+		return amqp.Queue{}, amqp.ErrClosed
+	}
+	if name == "" {
+		b.next_queue++
+		name = fmt.Sprintf("amq.gen-%d", b.next_queue)
+	}
+	q, ok := b.queues[name]
+	if !ok {
+		q = &brokerQueue{name: name, args: args}
+		if exclusive {
+			q.owner = ch.conn
+		}
+		b.queues[name] = q
+	}
+	return amqp.Queue{Name: name, Messages: len(q.messages)}, nil
+}
+
+func (ch *brokerChannel) QueueBind(name, key, exchange string, noWait bool, args amqp.Table) error {
+	b := ch.broker()
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	e, ok := b.exchanges[exchange]
+	if !ok {
+		return &amqp.Error{Code: amqp.NotFound, Reason: fmt.Sprintf("NOT_FOUND - no exchange '%s'", exchange)}
+	}
+	if _, ok := b.queues[name]; !ok {
+		return &amqp.Error{Code: amqp.NotFound, Reason: fmt.Sprintf("NOT_FOUND - no queue '%s'", name)}
+	}
+	e.bindings = append(e.bindings, brokerBinding{name, key})
+	return nil
+}
+
+func (ch *brokerChannel) ExchangeDeclare(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error {
+	b := ch.broker()
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	if e, ok := b.exchanges[name]; ok {
+		if e.kind != kind {
+			return &amqp.Error{Code: amqp.PreconditionFailed, Reason: fmt.Sprintf("PRECONDITION_FAILED - exchange '%s' is %s", name, e.kind)}
+		}
+		return nil
+	}
+	b.exchanges[name] = &brokerExchange{kind: kind}
+	return nil
+}
+
+func (ch *brokerChannel) Confirm(noWait bool) error {
+	b := ch.broker()
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	ch.confirm = true
+	return nil
+}
+
+func (ch *brokerChannel) NotifyPublish(confirm chan amqp.Confirmation) chan amqp.Confirmation {
+	b := ch.broker()
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if ch.closed {
+		close(confirm)
+	} else {
+		ch.confirms = append(ch.confirms, confirm)
+	}
+	return confirm
+}
+
+func (ch *brokerChannel) NotifyClose(receiver chan *amqp.Error) chan *amqp.Error {
+	b := ch.broker()
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if ch.closed {
+		close(receiver)
+	} else {
+		ch.notify = append(ch.notify, receiver)
+	}
+	return receiver
+}
+
+func (ch *brokerChannel) GetNextPublishSeqNo() uint64 {
+	b := ch.broker()
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if !ch.confirm {
+		return 0
+	}
+	return ch.next_tag
+}
+
+func (ch *brokerChannel) PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	b := ch.broker()
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+
+	ack := true
+	if b.nack_next > 0 {
+		b.nack_next--
+		ack = false
+	} else if err := b.route(exchange, key, msg); err != nil {
+		ch.close(err.(*amqp.Error))
+		return err
+	}
+	if !ch.confirm {
+		return nil
+	}
+	tag := ch.next_tag
+	ch.next_tag++
+	if !b.drop_confirms {
+		for _, c := range ch.confirms {
+			c <- amqp.Confirmation{DeliveryTag: tag, Ack: ack}
+		}
+	}
+	return nil
+}
+
+func (ch *brokerChannel) Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error) {
+	b := ch.broker()
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if ch.closed {
+		return nil, amqp.ErrClosed
+	}
+	q, ok := b.queues[queue]
+	if !ok {
+		err := &amqp.Error{Code: amqp.NotFound, Reason: fmt.Sprintf("NOT_FOUND - no queue '%s'", queue)}
+		ch.close(err)
+		return nil, err
+	}
+	c := &brokerConsumer{
+		channel:    ch,
+		queue:      q,
+		auto_ack:   autoAck,
+		deliveries: make(chan amqp.Delivery),
+		stop:       make(chan struct{}),
+	}
+	ch.consumers = append(ch.consumers, c)
+	go c.run()
+	return c.deliveries, nil
+}
+
+func (ch *brokerChannel) Get(queue string, autoAck bool) (amqp.Delivery, bool, error) {
+	b := ch.broker()
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if ch.closed {
+		return amqp.Delivery{}, false, amqp.ErrClosed
+	}
+	q, ok := b.queues[queue]
+	if !ok {
+		err := &amqp.Error{Code: amqp.NotFound, Reason: fmt.Sprintf("NOT_FOUND - no queue '%s'", queue)}
+		ch.close(err)
+		return amqp.Delivery{}, false, err
+	}
+	if len(q.messages) == 0 {
+		return amqp.Delivery{}, false, nil
+	}
+	m := q.messages[0]
+	q.messages = q.messages[1:]
+	return ch.deliver(q.name, m, autoAck), true, nil
+}
+
+// deliver hands out a message, remembering it until it is acked, must hold lock
+func (ch *brokerChannel) deliver(queue string, m brokerMessage, auto_ack bool) amqp.Delivery {
+	ch.delivery_tag++
+	tag := ch.delivery_tag
+	if !auto_ack {
+		ch.unacked[tag] = unackedMessage{queue, m}
+	}
+	p := m.publishing
+	return amqp.Delivery{
+		Acknowledger:    ch,
+		Headers:         p.Headers,
+		ContentType:     p.ContentType,
+		ContentEncoding: p.ContentEncoding,
+		DeliveryMode:    p.DeliveryMode,
+		Priority:        p.Priority,
+		CorrelationId:   p.CorrelationId,
+		ReplyTo:         p.ReplyTo,
+		Expiration:      p.Expiration,
+		MessageId:       p.MessageId,
+		Timestamp:       p.Timestamp,
+		Type:            p.Type,
+		UserId:          p.UserId,
+		AppId:           p.AppId,
+		DeliveryTag:     tag,
+		Redelivered:     m.redelivered,
+		Exchange:        m.exchange,
+		RoutingKey:      m.key,
+		Body:            p.Body,
+	}
+}
+
+// settle removes tag, or every tag up to it if multiple, from unacked and returns the removed tags, must hold lock
+func (ch *brokerChannel) settle(tag uint64, multiple bool) ([]uint64, error) {
+	if ch.closed {
+		return nil, amqp.ErrClosed
+	}
+	var tags []uint64
+	if multiple {
+		for t := range ch.unacked {
+			if t <= tag {
+				tags = append(tags, t)
+			}
+		}
+	} else if _, ok := ch.unacked[tag]; ok {
+		tags = append(tags, tag)
+	}
+	if len(tags) == 0 {
+		return nil, &amqp.Error{Code: amqp.PreconditionFailed, Reason: fmt.Sprintf("PRECONDITION_FAILED - unknown delivery tag %d", tag)}
+	}
+	return tags, nil
+}
+
+// Ack implements amqp.Acknowledger
+func (ch *brokerChannel) Ack(tag uint64, multiple bool) error {
+	b := ch.broker()
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	tags, err := ch.settle(tag, multiple)
+	if err != nil {
+		return err
+	}
+	for _, t := range tags {
+		delete(ch.unacked, t)
+	}
+	return nil
+}
+
+// Nack implements amqp.Acknowledger and AMQPChannel
+func (ch *brokerChannel) Nack(tag uint64, multiple, requeue bool) error {
+	b := ch.broker()
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	tags, err := ch.settle(tag, multiple)
+	if err != nil {
+		return err
+	}
+	if requeue {
+		b.requeue(ch.unacked, tags)
+		return nil
+	}
+	for _, t := range tags {
+		delete(ch.unacked, t)
+	}
+	return nil
+}
+
+// Reject implements amqp.Acknowledger
+func (ch *brokerChannel) Reject(tag uint64, requeue bool) error {
+	return ch.Nack(tag, false, requeue)
+}
+
+// brokerConsumer pushes the messages of a queue to a consumer
+type brokerConsumer struct {
+	channel    *brokerChannel
+	queue      *brokerQueue
+	auto_ack   bool
+	deliveries chan amqp.Delivery
+	stopped    bool
+	stop       chan struct{}
+}
+
+// cancel stops the consumer, must hold lock
+func (c *brokerConsumer) cancel() {
+	if c.stopped {
+		return
+	}
+	c.stopped = true
+	close(c.stop)
+	c.channel.broker().cond.Broadcast()
+}
+
+func (c *brokerConsumer) run() {
+	b := c.channel.broker()
+	defer close(c.deliveries)
+	for {
+		b.lock.Lock()
+		for !c.stopped && len(c.queue.messages) == 0 {
+			b.cond.Wait()
+		}
+		if c.stopped {
+			b.lock.Unlock()
+			return
+		}
+		m := c.queue.messages[0]
+		c.queue.messages = c.queue.messages[1:]
+		d := c.channel.deliver(c.queue.name, m, c.auto_ack)
+		b.lock.Unlock()
+
+		select {
+		case c.deliveries <- d:
+		case <-c.stop:
+			// never handed out, put it back unless closing the channel already did
+			b.lock.Lock()
+			if c.auto_ack {
+				c.queue.messages = append([]brokerMessage{m}, c.queue.messages...)
+			} else if _, ok := c.channel.unacked[d.DeliveryTag]; ok {
+				b.requeue(c.channel.unacked, []uint64{d.DeliveryTag})
+			}
+			b.lock.Unlock()
+			return
+		}
+	}
+}
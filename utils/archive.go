@@ -0,0 +1,549 @@
+package utils
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ArchiveConfig configures the local skin archive
+type ArchiveConfig struct {
+	// Dir is where the archive is stored, empty disables it
+	Dir string
+	// MaxAge removes skins that havent been seen for this long, 0 keeps them forever
+	MaxAge time.Duration
+	// MaxSize in bytes, the least recently seen skins are removed above it, 0 is unlimited
+	MaxSize int64
+}
+
+// ArchiveSighting is one line of the archive index
+type ArchiveSighting struct {
+	Xuid     string
+	Username string
+	Server   string
+	Time     int64
+	Hash     string
+}
+
+type archiveObject struct {
+	lastSeen int64
+	size     int64
+}
+
+// Archive stores every unique skin once, addressed by the hash of its data
+//
+//	<Dir>/objects/ab/cd/abcd.../skin.json|skin.png|geometry.json
+//	<Dir>/index.jsonl
+type Archive struct {
+	config ArchiveConfig
+
+	lock    sync.Mutex
+	index   *os.File
+	objects map[string]*archiveObject
+	size    int64
+
+	done chan struct{}
+}
+
+const archiveIndexFile = "index.jsonl"
+
+// OpenArchive opens or creates the archive in config.Dir
+func OpenArchive(config ArchiveConfig) (*Archive, error) {
+	if err := os.MkdirAll(filepath.Join(config.Dir, "objects"), 0o755); err != nil {
+		return nil, err
+	}
+
+	a := &Archive{
+		config:  config,
+		objects: make(map[string]*archiveObject),
+		done:    make(chan struct{}),
+	}
+	if err := a.load(); err != nil {
+		return nil, err
+	}
+
+	var err error
+	a.index, err = os.OpenFile(filepath.Join(config.Dir, archiveIndexFile), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := a.Prune(); err != nil {
+		logrus.Warnf("Archive prune: %s", err)
+	}
+	go a.pruneLoop()
+	return a, nil
+}
+
+// load reads the index and sizes of all objects
+func (a *Archive) load() error {
+	err := a.readIndex(func(s *ArchiveSighting) {
+		o, ok := a.objects[s.Hash]
+		if !ok {
+			o = &archiveObject{}
+			a.objects[s.Hash] = o
+		}
+		if s.Time > o.lastSeen {
+			o.lastSeen = s.Time
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	for hash, o := range a.objects {
+		files, err := os.ReadDir(a.objectDir(hash))
+		if err != nil {
+			if os.IsNotExist(err) {
+				delete(a.objects, hash)
+				continue
+			}
+			return err
+		}
+		for _, f := range files {
+			if info, err := f.Info(); err == nil {
+				o.size += info.Size()
+			}
+		}
+		a.size += o.size
+	}
+	return nil
+}
+
+// readIndex calls f for every sighting in the index
+func (a *Archive) readIndex(f func(s *ArchiveSighting)) error {
+	file, err := os.Open(filepath.Join(a.config.Dir, archiveIndexFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer file.Close()
+	return readSightings(file, f)
+}
+
+func readSightings(r io.Reader, f func(s *ArchiveSighting)) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		var s ArchiveSighting
+		if err := json.Unmarshal(scanner.Bytes(), &s); err != nil {
+			logrus.Warnf("Archive: skipping bad index line %s", err)
+			continue
+		}
+		f(&s)
+	}
+	return scanner.Err()
+}
+
+func (a *Archive) objectDir(hash string) string {
+	return filepath.Join(a.config.Dir, "objects", hash[0:2], hash[2:4], hash)
+}
+
+// SkinHash is the content hash a skin is stored under
+func SkinHash(skin *JsonSkinData) (string, error) {
+	data, err := json.Marshal(skin)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// Put stores the skin if its new and records the sighting
+func (a *Archive) Put(skin *QueuedSkin) error {
+	hash, err := SkinHash(skin.Skin)
+	if err != nil {
+		return err
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	o, ok := a.objects[hash]
+	if !ok {
+		size, err := a.writeObject(hash, skin.Skin)
+		if err != nil {
+			return err
+		}
+		o = &archiveObject{size: size}
+		a.objects[hash] = o
+		a.size += size
+	}
+	if skin.Time > o.lastSeen {
+		o.lastSeen = skin.Time
+	}
+
+	return a.appendSighting(&ArchiveSighting{
+		Xuid:     skin.Xuid,
+		Username: skin.Username,
+		Server:   skin.ServerAddress,
+		Time:     skin.Time,
+		Hash:     hash,
+	})
+}
+
+func (a *Archive) appendSighting(s *ArchiveSighting) error {
+	line, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	_, err = a.index.Write(append(line, '\n'))
+	return err
+}
+
+// writeObject writes the files of a skin to a temporary dir and moves it in place
+func (a *Archive) writeObject(hash string, skin *JsonSkinData) (size int64, err error) {
+	dir := a.objectDir(hash)
+	if _, err := os.Stat(dir); err == nil {
+		// a crash after the rename left the object without its index line
+		if size, ok := storedObject(hash, dir); ok {
+			return size, nil
+		}
+		logrus.Warnf("Archive: replacing broken object %s", hash)
+		if err := os.RemoveAll(dir); err != nil {
+			return 0, err
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(dir), 0o755); err != nil {
+		return 0, err
+	}
+	tmp, err := os.MkdirTemp(filepath.Dir(dir), ".tmp-")
+	if err != nil {
+		return 0, err
+	}
+	defer os.RemoveAll(tmp)
+
+	files := map[string][]byte{}
+	files["skin.json"], err = json.Marshal(skin)
+	if err != nil {
+		return 0, err
+	}
+	if geometry, err := base64.RawStdEncoding.DecodeString(skin.SkinGeometry); err == nil && len(geometry) > 0 {
+		files["geometry.json"] = geometry
+	}
+	if img, err := renderSkin(skin); err == nil {
+		files["skin.png"] = img
+	} else {
+		logrus.Debugf("Archive: not rendering %s %s", hash, err)
+	}
+
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(tmp, name), data, 0o644); err != nil {
+			return 0, err
+		}
+		size += int64(len(data))
+	}
+
+	if err := os.Rename(tmp, dir); err != nil {
+		return 0, err
+	}
+	return size, nil
+}
+
+// storedObject checks that dir holds the skin with hash and returns the size of its files
+func storedObject(hash, dir string) (int64, bool) {
+	data, err := os.ReadFile(filepath.Join(dir, "skin.json"))
+	if err != nil {
+		return 0, false
+	}
+	var skin JsonSkinData
+	if err := json.Unmarshal(data, &skin); err != nil {
+		return 0, false
+	}
+	if h, err := SkinHash(&skin); err != nil || h != hash {
+		return 0, false
+	}
+
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return 0, false
+	}
+	var size int64
+	for _, f := range files {
+		if info, err := f.Info(); err == nil {
+			size += info.Size()
+		}
+	}
+	return size, true
+}
+
+// renderSkin encodes the skin texture as png
+func renderSkin(skin *JsonSkinData) ([]byte, error) {
+	data, err := base64.RawStdEncoding.DecodeString(skin.SkinData)
+	if err != nil {
+		return nil, err
+	}
+	w, h := int(skin.SkinImageWidth), int(skin.SkinImageHeight)
+	if w == 0 || h == 0 || len(data) != w*h*4 {
+		return nil, fmt.Errorf("skin data is %d bytes for %dx%d", len(data), w, h)
+	}
+
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	copy(img.Pix, data)
+
+	buf := bytes.NewBuffer(nil)
+	if err := png.Encode(buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (a *Archive) pruneLoop() {
+	t := time.NewTicker(1 * time.Hour)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			if err := a.Prune(); err != nil {
+				logrus.Warnf("Archive prune: %s", err)
+			}
+		case <-a.done:
+			return
+		}
+	}
+}
+
+// Prune removes skins that are past MaxAge or over MaxSize and compacts the index
+func (a *Archive) Prune() error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	type entry struct {
+		hash string
+		*archiveObject
+	}
+	entries := make([]entry, 0, len(a.objects))
+	for hash, o := range a.objects {
+		entries = append(entries, entry{hash, o})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].lastSeen < entries[j].lastSeen
+	})
+
+	removed := map[string]bool{}
+	size := a.size
+	cutoff := time.Now().Add(-a.config.MaxAge).Unix()
+	for _, e := range entries {
+		tooOld := a.config.MaxAge > 0 && e.lastSeen < cutoff
+		tooBig := a.config.MaxSize > 0 && size > a.config.MaxSize
+		if !tooOld && !tooBig {
+			break
+		}
+		if err := os.RemoveAll(a.objectDir(e.hash)); err != nil {
+			return err
+		}
+		removed[e.hash] = true
+		size -= e.size
+		delete(a.objects, e.hash)
+	}
+	a.size = size
+
+	if len(removed) == 0 {
+		return nil
+	}
+	logrus.Infof("Archive: removed %d skins", len(removed))
+	return a.compactIndex(removed)
+}
+
+// compactIndex rewrites the index without sightings of removed skins
+func (a *Archive) compactIndex(removed map[string]bool) error {
+	index_path := filepath.Join(a.config.Dir, archiveIndexFile)
+	tmp, err := os.Create(index_path + ".tmp")
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(tmp)
+	err = a.readIndex(func(s *ArchiveSighting) {
+		if removed[s.Hash] {
+			return
+		}
+		line, _ := json.Marshal(s)
+		w.Write(append(line, '\n'))
+	})
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	tmp.Close()
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	a.index.Close()
+	if err := os.Rename(tmp.Name(), index_path); err != nil {
+		return err
+	}
+	a.index, err = os.OpenFile(index_path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	return err
+}
+
+// Export writes the whole archive as a tar.gz
+func (a *Archive) Export(w io.Writer) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	gw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gw)
+	err := filepath.Walk(a.config.Dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(a.config.Dir, path)
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || strings.Contains(rel, ".tmp") {
+			return nil
+		}
+		hdr, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(rel)
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gw.Close()
+}
+
+// Import merges an archive written by Export into this one.
+// only skin.json is taken from it, the other files are rendered again from the skin
+func (a *Archive) Import(r io.Reader) (imported int, err error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	gr, err := gzip.NewReader(r)
+	if err != nil {
+		return 0, err
+	}
+	tr := tar.NewReader(gr)
+	var sightings []*ArchiveSighting
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return imported, err
+		}
+
+		if hdr.Name == archiveIndexFile {
+			if err := readSightings(tr, func(s *ArchiveSighting) {
+				sightings = append(sightings, s)
+			}); err != nil {
+				return imported, err
+			}
+			continue
+		}
+
+		// objects/ab/cd/<hash>/<file>
+		parts := strings.Split(hdr.Name, "/")
+		if len(parts) != 5 || parts[0] != "objects" || !isSkinHash(parts[3]) || parts[1] != parts[3][0:2] || parts[2] != parts[3][2:4] {
+			logrus.Warnf("Archive import: skipping %s", hdr.Name)
+			continue
+		}
+		hash := parts[3]
+		if parts[4] != "skin.json" {
+			continue
+		}
+		if _, ok := a.objects[hash]; ok {
+			continue
+		}
+
+		var skin JsonSkinData
+		if err := json.NewDecoder(tr).Decode(&skin); err != nil {
+			logrus.Warnf("Archive import: skipping %s %s", hdr.Name, err)
+			continue
+		}
+		if h, err := SkinHash(&skin); err != nil || h != hash {
+			logrus.Warnf("Archive import: skipping %s, it doesnt match its hash", hdr.Name)
+			continue
+		}
+		size, err := a.writeObject(hash, &skin)
+		if err != nil {
+			return imported, err
+		}
+		a.objects[hash] = &archiveObject{size: size}
+		a.size += size
+		imported++
+	}
+
+	// the same sighting can be in both archives
+	known := map[ArchiveSighting]bool{}
+	if err := a.readIndex(func(s *ArchiveSighting) {
+		known[*s] = true
+	}); err != nil {
+		return imported, err
+	}
+	for _, s := range sightings {
+		o, ok := a.objects[s.Hash]
+		if !ok || known[*s] {
+			continue
+		}
+		known[*s] = true
+		if s.Time > o.lastSeen {
+			o.lastSeen = s.Time
+		}
+		if err := a.appendSighting(s); err != nil {
+			return imported, err
+		}
+	}
+	return imported, nil
+}
+
+// isSkinHash checks that s is a hash from SkinHash so it is safe to use in paths
+func isSkinHash(s string) bool {
+	if len(s) != sha256.Size*2 {
+		return false
+	}
+	for _, c := range s {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// Close stops pruning and closes the index
+func (a *Archive) Close() error {
+	close(a.done)
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.index.Close()
+}
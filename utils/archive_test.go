@@ -0,0 +1,159 @@
+package utils_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bedrockteam/skin-bot/utils"
+)
+
+func openArchive(t *testing.T, dir string) *utils.Archive {
+	a, err := utils.OpenArchive(utils.ArchiveConfig{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { a.Close() })
+	return a
+}
+
+func indexLines(t *testing.T, dir string) int {
+	data, err := os.ReadFile(filepath.Join(dir, "index.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Count(string(data), "\n")
+}
+
+// importing an archive twice or into one that has some of its skins doesnt duplicate anything
+func TestArchiveImport(t *testing.T) {
+	from := openArchive(t, t.TempDir())
+	skin1, skin2 := testSkin(1), testSkin(2)
+	seen_again := *skin1
+	seen_again.Time++
+	for _, skin := range []*utils.QueuedSkin{skin1, skin2, &seen_again} {
+		if err := from.Put(skin); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var export bytes.Buffer
+	if err := from.Export(&export); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	to := openArchive(t, dir)
+	if err := to.Put(skin1); err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []int{1, 0} {
+		imported, err := to.Import(bytes.NewReader(export.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if imported != want {
+			t.Errorf("import %d: imported %d skins, wanted %d", i, imported, want)
+		}
+	}
+	// the sighting put into both is only there once
+	if n := indexLines(t, dir); n != 3 {
+		t.Errorf("index has %d sightings, wanted 3", n)
+	}
+}
+
+// objects with bad paths or that dont match their hash are skipped
+func TestArchiveImportRejects(t *testing.T) {
+	skin := testSkin(1).Skin
+	hash, err := utils.SkinHash(skin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	good, _ := json.Marshal(skin)
+	other := testSkin(2).Skin
+	tampered, _ := json.Marshal(other)
+
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	for name, data := range map[string][]byte{
+		"objects/" + hash[0:2] + "/" + hash[2:4] + "/" + hash + "/skin.json":                             tampered,
+		"objects/" + hash[0:2] + "/" + hash[2:4] + "/" + strings.ToUpper(hash) + "/skin.json":            good,
+		"objects/../../" + hash + "/skin.json":                                                           good,
+		"objects/" + hash[0:2] + "/" + hash[2:4] + "/" + "../../../../../../" + hash[18:] + "/skin.json": good,
+		"objects/" + hash[0:2] + "/" + hash[2:4] + "/" + hash + "/skin.png":                              []byte("not a png"),
+		"index.jsonl": []byte(`{"Xuid":"1","Hash":"` + hash + `"}` + "\n"),
+	} {
+		tw.WriteHeader(&tar.Header{Name: name, Mode: 0o644, Size: int64(len(data))})
+		tw.Write(data)
+	}
+	tw.Close()
+	gw.Close()
+
+	dir := t.TempDir()
+	a := openArchive(t, filepath.Join(dir, "archive"))
+	imported, err := a.Import(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if imported != 0 {
+		t.Errorf("imported %d skins", imported)
+	}
+	if n := indexLines(t, filepath.Join(dir, "archive")); n != 0 {
+		t.Errorf("index has %d sightings", n)
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 {
+		t.Errorf("import wrote outside the archive: %v", entries)
+	}
+}
+
+// an object written before a crash that lost its index line is reused, a broken one is replaced
+func TestArchiveObjectWithoutIndex(t *testing.T) {
+	dir := t.TempDir()
+	a, err := utils.OpenArchive(utils.ArchiveConfig{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	skin1, skin2 := testSkin(1), testSkin(2)
+	if err := a.Put(skin1); err != nil {
+		t.Fatal(err)
+	}
+	a.Close()
+	if err := os.Truncate(filepath.Join(dir, "index.jsonl"), 0); err != nil {
+		t.Fatal(err)
+	}
+	hash, err := utils.SkinHash(skin2.Skin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	broken := filepath.Join(dir, "objects", hash[0:2], hash[2:4], hash)
+	if err := os.MkdirAll(broken, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(broken, "skin.json"), []byte("{"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	a = openArchive(t, dir)
+	for _, skin := range []*utils.QueuedSkin{skin1, skin2} {
+		if err := a.Put(skin); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := indexLines(t, dir); n != 2 {
+		t.Errorf("index has %d sightings, wanted 2", n)
+	}
+	data, err := os.ReadFile(filepath.Join(broken, "skin.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stored utils.JsonSkinData
+	if err := json.Unmarshal(data, &stored); err != nil || stored.SkinID != skin2.Skin.SkinID {
+		t.Errorf("broken object was not replaced: %s", data)
+	}
+}
@@ -0,0 +1,145 @@
+package utils
+
+import (
+	"context"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// AssignmentConfig configures getting the servers to join from the api server
+type AssignmentConfig struct {
+	// Enabled connects only to the server instances the api server leases to this node, instead of ServerAddresses
+	Enabled bool
+}
+
+// Assignment is a server instance leased to this node
+type Assignment struct {
+	LeaseId string
+	// Server is the address from the server list
+	Server string
+	// Address is the ip:port of the instance
+	Address string
+	// Expires is the unix time the lease ends unless it is renewed
+	Expires int64
+}
+
+// assignmentRequest renews the held leases, the api server answers with all leases of the node.
+// leases that conflict with other nodes are not in the answer anymore.
+type assignmentRequest struct {
+	Capacity int
+	Leases   []string
+}
+
+type assignmentResponse struct {
+	Assignments []Assignment
+}
+
+// Assignments keeps the leases of this node renewed
+type Assignments struct {
+	client   *Client
+	capacity int
+
+	lock    sync.Mutex
+	current []Assignment
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// time between renewals
+var (
+	minAssignmentRenew = 5 * time.Second
+	maxAssignmentRenew = 1 * time.Minute
+	assignmentRetry    = 10 * time.Second
+)
+
+// StartAssignments starts leasing server instances for up to capacity bots, 0 leaves it to the api server.
+// Close releases the leases.
+func (u *Client) StartAssignments(capacity int) *Assignments {
+	ctx, cancel := context.WithCancel(context.Background())
+	a := &Assignments{
+		client:   u,
+		capacity: capacity,
+		cancel:   cancel,
+		done:     make(chan struct{}),
+	}
+	u.assignments = a
+	go a.run(ctx)
+	return a
+}
+
+// Current returns the leases that have not expired
+func (a *Assignments) Current() []Assignment {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	now := time.Now().Unix()
+	var ret []Assignment
+	for _, l := range a.current {
+		if l.Expires > now {
+			ret = append(ret, l)
+		}
+	}
+	return ret
+}
+
+func (a *Assignments) path() string {
+	return "/nodes/" + url.PathEscape(a.client.NodeId) + "/assignments"
+}
+
+// renew sends the held leases and takes the answer as the new leases, returns when to renew next
+func (a *Assignments) renew(ctx context.Context) (time.Duration, error) {
+	req := assignmentRequest{Capacity: a.capacity}
+	for _, l := range a.Current() {
+		req.Leases = append(req.Leases, l.LeaseId)
+	}
+	var resp assignmentResponse
+	if err := a.client.jsonRequest(ctx, "POST", a.path(), req, &resp); err != nil {
+		return assignmentRetry, err
+	}
+
+	a.lock.Lock()
+	a.current = resp.Assignments
+	a.lock.Unlock()
+
+	// renew at half of the shortest lease
+	next := maxAssignmentRenew
+	now := time.Now()
+	for _, l := range resp.Assignments {
+		if d := time.Unix(l.Expires, 0).Sub(now) / 2; d < next {
+			next = d
+		}
+	}
+	if next < minAssignmentRenew {
+		next = minAssignmentRenew
+	}
+	return next, nil
+}
+
+func (a *Assignments) run(ctx context.Context) {
+	defer close(a.done)
+	for {
+		next, err := a.renew(ctx)
+		if err != nil && ctx.Err() == nil {
+			logrus.Warnf("Renewing assignments: %s", err)
+		}
+		select {
+		case <-time.After(next):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// close stops renewing and releases the leases so other nodes can take them right away
+func (a *Assignments) close() {
+	a.cancel()
+	<-a.done
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := a.client.jsonRequest(ctx, "DELETE", a.path(), nil, nil); err != nil {
+		logrus.Warnf("Releasing assignments: %s", err)
+	}
+}
@@ -3,19 +3,71 @@ package utils
 import (
 	"context"
 	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"os"
 	"path"
+	"strings"
 	"sync"
+	"time"
 
+	"github.com/google/uuid"
 	"github.com/sandertv/gophertunnel/minecraft"
 	"github.com/sandertv/gophertunnel/minecraft/auth"
+	"github.com/sandertv/gophertunnel/minecraft/protocol/login"
 	"github.com/sirupsen/logrus"
 	"golang.org/x/oauth2"
 )
 
 const TOKEN_FILE = "token.json"
 
+// Account is who a bot logs in as
+type Account struct {
+	Name string
+	// Offline logs in without xbox auth with a self-signed chain, only servers with online-mode off accept it
+	Offline bool
+	// DisplayName is the in game name of an offline account, defaults to Name
+	DisplayName string
+}
+
+// offlineChain is what the dialer has instead of a chain for offline accounts,
+// it signs the login itself with the key so there is nothing to fetch
+const offlineChain = "offline"
+
+// offlineIdentity is the identity of an offline account, the uuid stays the same for a name
+func (a Account) offlineIdentity() login.IdentityData {
+	name := a.DisplayName
+	if name == "" {
+		name = a.Name
+	}
+	return login.IdentityData{
+		DisplayName: name,
+		Identity:    uuid.NewSHA1(uuid.NameSpaceOID, []byte("OfflinePlayer:"+name)).String(),
+	}
+}
+
+// getOfflineChain gets the self-signing key for an offline account
+func getOfflineChain(name string) (*ecdsa.PrivateKey, error) {
+	chain_lock.Lock()
+	defer chain_lock.Unlock()
+	if chain, ok := chains["offline:"+name]; ok {
+		return chain.key, nil
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	chains["offline:"+name] = &MCChain{
+		key:       key,
+		chainData: offlineChain,
+	}
+	return key, nil
+}
+
 type MCChain struct {
 	key       *ecdsa.PrivateKey
 	chainData string
@@ -29,31 +81,42 @@ var (
 	chain_lock = &sync.Mutex{}
 )
 
-// GetTokenSource returns the token source for this username
-func GetTokenSource(name string) oauth2.TokenSource {
+// ErrNoToken is returned for accounts that were not logged in with `skin-bot accounts login`
+var ErrNoToken = errors.New("no token, run skin-bot accounts login")
+
+// AccountToken is a saved login
+type AccountToken struct {
+	Name   string
+	Expiry time.Time
+}
+
+// GetTokenSource returns the token source for this username, it never asks for a login
+func GetTokenSource(name string) (oauth2.TokenSource, error) {
 	token_lock.Lock()
 	defer token_lock.Unlock()
 
 	if token, ok := tokens[name]; ok {
-		return token
+		return token, nil
 	}
 
 	token, err := read_token(name)
 	if err != nil {
-		logrus.Errorf("failed to read token for %s", name)
+		return nil, err
 	}
 
-	tokens[name] = auth.RefreshTokenSource(token)
-	new_token, err := tokens[name].Token()
+	src := auth.RefreshTokenSource(token)
+	new_token, err := src.Token()
 	if err != nil {
-		panic(err)
+		return nil, fmt.Errorf("refreshing token of %s: %w", name, err)
 	}
 	if !token.Valid() {
 		logrus.Infof("Refreshed token for %s", name)
-		write_token(name, new_token)
+		if err := write_token(name, new_token); err != nil {
+			return nil, err
+		}
 	}
-
-	return tokens[name]
+	tokens[name] = src
+	return src, nil
 }
 
 // GetChain gets a chain for this user
@@ -63,7 +126,11 @@ func GetChain(name string) (key *ecdsa.PrivateKey, chainData string, err error)
 	if chain, ok := chains[name]; ok {
 		return chain.key, chain.chainData, nil
 	}
-	key, chainData, err = minecraft.CreateChain(context.Background(), GetTokenSource(name))
+	src, err := GetTokenSource(name)
+	if err != nil {
+		return nil, "", err
+	}
+	key, chainData, err = minecraft.CreateChain(context.Background(), src)
 	if err != nil {
 		return nil, "", err
 	}
@@ -74,39 +141,140 @@ func GetChain(name string) (key *ecdsa.PrivateKey, chainData string, err error)
 	return key, chainData, nil
 }
 
-// write_token writes the token for this user to a json file
-func write_token(name string, token *oauth2.Token) {
-	os.Mkdir("tokens", 0o775)
-	fname := path.Join("tokens", name+".json")
-	buf, err := json.Marshal(token)
+// LoginAccount runs the device code login for name, the instructions are written to w
+func LoginAccount(name string, w io.Writer) error {
+	if _, err := tokenPath(name); err != nil {
+		return err
+	}
+	token, err := auth.RequestLiveTokenWriter(w)
 	if err != nil {
-		panic(err)
+		return err
 	}
-	os.WriteFile(fname, buf, 0o755)
+	forget_account(name)
+	return write_token(name, token)
 }
 
-// read_token reads the token of this user from a json file
-// asks for interactive login if not found
-func read_token(name string) (*oauth2.Token, error) {
-	fname := path.Join("tokens", name+".json")
-	if _, err := os.Stat(fname); err == nil {
-		f, err := os.Open(fname)
-		if err != nil {
-			panic(err)
+// RefreshAccount refreshes the saved token of name even if it is still valid
+func RefreshAccount(name string) (*oauth2.Token, error) {
+	token, err := read_token(name)
+	if err != nil {
+		return nil, err
+	}
+	expired := *token
+	expired.Expiry = time.Unix(1, 0)
+	new_token, err := auth.RefreshTokenSource(&expired).Token()
+	if err != nil {
+		return nil, fmt.Errorf("refreshing token of %s: %w", name, err)
+	}
+	forget_account(name)
+	return new_token, write_token(name, new_token)
+}
+
+// CheckAccount checks that name can log in to xbox live
+func CheckAccount(ctx context.Context, name string) error {
+	src, err := GetTokenSource(name)
+	if err != nil {
+		return err
+	}
+	_, _, err = minecraft.CreateChain(ctx, src)
+	return err
+}
+
+// RemoveAccount deletes the saved token of name
+func RemoveAccount(name string) error {
+	fname, err := tokenPath(name)
+	if err != nil {
+		return err
+	}
+	forget_account(name)
+	if err := os.Remove(fname); err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("%s: %w", name, ErrNoToken)
 		}
-		defer f.Close()
-		var token oauth2.Token
-		if err := json.NewDecoder(f).Decode(&token); err != nil {
-			return nil, err
+		return err
+	}
+	return nil
+}
+
+// ListAccounts lists the saved tokens
+func ListAccounts() ([]AccountToken, error) {
+	files, err := os.ReadDir("tokens")
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var accounts []AccountToken
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), ".json") {
+			continue
 		}
-		return &token, nil
-	} else {
-		logrus.Infof("Login for %s", name)
-		_token, err := auth.RequestLiveToken()
+		name := strings.TrimSuffix(f.Name(), ".json")
+		token, err := read_token(name)
 		if err != nil {
-			return nil, err
+			logrus.Warnf("%s: %s", f.Name(), err)
+			continue
 		}
-		write_token(name, _token)
-		return _token, nil
+		accounts = append(accounts, AccountToken{Name: name, Expiry: token.Expiry})
+	}
+	return accounts, nil
+}
+
+// forget_account drops the cached token and chain of name
+func forget_account(name string) {
+	token_lock.Lock()
+	delete(tokens, name)
+	token_lock.Unlock()
+	chain_lock.Lock()
+	delete(chains, name)
+	chain_lock.Unlock()
+}
+
+// tokenPath is the token file of name
+func tokenPath(name string) (string, error) {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return "", fmt.Errorf("bad account name %q", name)
+	}
+	return path.Join("tokens", name+".json"), nil
+}
+
+// write_token writes the token for this user to a json file only the owner can read
+func write_token(name string, token *oauth2.Token) error {
+	fname, err := tokenPath(name)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll("tokens", 0o700); err != nil {
+		return err
+	}
+	buf, err := json.Marshal(token)
+	if err != nil {
+		return err
+	}
+	tmp := fname + ".tmp"
+	if err := os.WriteFile(tmp, buf, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, fname)
+}
+
+// read_token reads the token of this user from a json file, ErrNoToken if there is none
+func read_token(name string) (*oauth2.Token, error) {
+	fname, err := tokenPath(name)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(fname)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%s: %w", name, ErrNoToken)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var token oauth2.Token
+	if err := json.Unmarshal(data, &token); err != nil {
+		return nil, fmt.Errorf("%s: %s", fname, err)
 	}
+	return &token, nil
 }
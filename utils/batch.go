@@ -0,0 +1,151 @@
+package utils
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// BatchConfig groups skins into one message, a batch is published when any limit is reached
+type BatchConfig struct {
+	// Count is the most skins in a batch, 0 or 1 disables batching
+	Count int
+	// Bytes is the most uncompressed bytes in a batch, 0 is unlimited
+	Bytes int
+	// Linger is how long the first skin of a batch waits for more, defaults to 100ms
+	Linger time.Duration
+}
+
+type batchItem struct {
+	encodedSkin
+	done chan error
+}
+
+// pendingBatch is a batch that is still filling up
+type pendingBatch struct {
+	items []batchItem
+	size  int
+	timer *time.Timer
+}
+
+// skinBatcher collects the skins of concurrent senders into batches per key
+type skinBatcher struct {
+	config BatchConfig
+	format string
+	// key groups skins, only skins with the same key are batched together
+	key func(skin *QueuedSkin) string
+	// publish sends a full batch
+	publish func(key string, skins []encodedSkin) error
+
+	lock    sync.Mutex
+	pending map[string]*pendingBatch
+}
+
+func newSkinBatcher(config BatchConfig, format string, key func(skin *QueuedSkin) string, publish func(key string, skins []encodedSkin) error) *skinBatcher {
+	if config.Linger == 0 {
+		config.Linger = 100 * time.Millisecond
+	}
+	return &skinBatcher{
+		config:  config,
+		format:  format,
+		key:     key,
+		publish: publish,
+		pending: make(map[string]*pendingBatch),
+	}
+}
+
+// full checks if adding size bytes would go over the limits
+func (b *skinBatcher) full(count, size, add int) bool {
+	if count >= b.config.Count {
+		return true
+	}
+	return b.config.Bytes > 0 && count > 0 && size+add > b.config.Bytes
+}
+
+// split cuts skins into batches that stay in the limits
+func (b *skinBatcher) split(skins []encodedSkin) [][]encodedSkin {
+	var batches [][]encodedSkin
+	var batch []encodedSkin
+	size := 0
+	for _, skin := range skins {
+		if b.full(len(batch), size, len(skin.body)) {
+			batches = append(batches, batch)
+			batch, size = nil, 0
+		}
+		batch = append(batch, skin)
+		size += len(skin.body)
+	}
+	if len(batch) > 0 {
+		batches = append(batches, batch)
+	}
+	return batches
+}
+
+// add puts skin in the pending batch for its key and waits until that batch is published
+func (b *skinBatcher) add(ctx context.Context, skin *QueuedSkin) error {
+	body, err := encodeSkinBody(skin, b.format)
+	if err != nil {
+		return err
+	}
+	key := b.key(skin)
+	done := make(chan error, 1)
+
+	var ready []*pendingBatch
+	b.lock.Lock()
+	p := b.pending[key]
+	if p != nil && b.full(len(p.items), p.size, len(body)) {
+		ready = append(ready, b.take(key, p))
+		p = nil
+	}
+	if p == nil {
+		p = &pendingBatch{}
+		b.pending[key] = p
+		p.timer = time.AfterFunc(b.config.Linger, func() {
+			b.lock.Lock()
+			batch := b.take(key, p)
+			b.lock.Unlock()
+			if batch != nil {
+				b.flush(key, batch)
+			}
+		})
+	}
+	p.items = append(p.items, batchItem{encodedSkin{skin, body}, done})
+	p.size += len(body)
+	if len(p.items) >= b.config.Count {
+		ready = append(ready, b.take(key, p))
+	}
+	b.lock.Unlock()
+
+	for _, p := range ready {
+		go b.flush(key, p)
+	}
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// take removes p from pending if it is still there, must hold lock
+func (b *skinBatcher) take(key string, p *pendingBatch) *pendingBatch {
+	if b.pending[key] != p {
+		return nil
+	}
+	delete(b.pending, key)
+	p.timer.Stop()
+	return p
+}
+
+// flush publishes a batch and reports the result to everyone waiting on it
+func (b *skinBatcher) flush(key string, p *pendingBatch) {
+	encoded := make([]encodedSkin, 0, len(p.items))
+	for _, item := range p.items {
+		encoded = append(encoded, item.encodedSkin)
+	}
+	err := b.publish(key, encoded)
+	for _, item := range p.items {
+		item.done <- err
+	}
+}
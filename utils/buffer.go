@@ -0,0 +1,155 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// bufferBatch is the most buffered skins sent at once to a sink that takes batches
+const bufferBatch = 256
+
+// bufferCloseTimeout is how long Close keeps trying to send the skins that are still buffered
+var bufferCloseTimeout = 10 * time.Second
+
+// bufferSink holds skins in memory and sends them to inner in the background,
+// so the bots dont wait for the api server or the broker
+type bufferSink struct {
+	inner Sink
+	skins chan *QueuedSkin
+	// linger is how long the first skin waits for more when inner takes batches
+	linger time.Duration
+	// dropped is called with the number of skins inner rejected for good
+	dropped func(n int)
+
+	closing chan struct{}
+	ctx     context.Context
+	cancel  context.CancelFunc
+	done    chan struct{}
+}
+
+func newBufferSink(inner Sink, size int, linger time.Duration, dropped func(n int)) *bufferSink {
+	ctx, cancel := context.WithCancel(context.Background())
+	b := &bufferSink{
+		inner:   inner,
+		skins:   make(chan *QueuedSkin, size),
+		linger:  linger,
+		dropped: dropped,
+		closing: make(chan struct{}),
+		ctx:     ctx,
+		cancel:  cancel,
+		done:    make(chan struct{}),
+	}
+	go b.run()
+	return b
+}
+
+// Send implements Sink, it fails if the buffer is full
+func (b *bufferSink) Send(ctx context.Context, skin *QueuedSkin) error {
+	select {
+	case b.skins <- skin:
+		return nil
+	default:
+		return fmt.Errorf("buffer full, dropped skin of %s", skin.Username)
+	}
+}
+
+// Close implements Sink, it sends the skins that are still buffered for up to bufferCloseTimeout
+func (b *bufferSink) Close() error {
+	close(b.closing)
+	t := time.AfterFunc(bufferCloseTimeout, b.cancel)
+	<-b.done
+	t.Stop()
+	b.cancel()
+	if n := len(b.skins); n > 0 {
+		logrus.Warnf("Buffer: %d skins were not sent", n)
+	}
+	return b.inner.Close()
+}
+
+func (b *bufferSink) run() {
+	defer close(b.done)
+	for {
+		var skins []*QueuedSkin
+		select {
+		case skin := <-b.skins:
+			skins = append(skins, skin)
+		case <-b.closing:
+			select {
+			case skin := <-b.skins:
+				skins = append(skins, skin)
+			default:
+				return
+			}
+		case <-b.ctx.Done():
+			return
+		}
+		if _, ok := b.inner.(batchSink); ok {
+			skins = b.collect(skins)
+		}
+
+		for {
+			err := b.send(skins)
+			if err == nil {
+				break
+			}
+			if b.ctx.Err() != nil {
+				return
+			}
+			var upload_err *uploadError
+			if errors.As(err, &upload_err) {
+				logrus.Warnf("Buffer: %s, dropped %d skins", err, len(skins))
+				if b.dropped != nil {
+					b.dropped(len(skins))
+				}
+				break
+			}
+			logrus.Warnf("Buffer: %s", err)
+			select {
+			case <-time.After(publishRetryDelay):
+			case <-b.ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+// collect adds the skins that arrive within linger to skins, once Close was called it only takes what is there
+func (b *bufferSink) collect(skins []*QueuedSkin) []*QueuedSkin {
+	var timeout <-chan time.Time
+	if b.linger > 0 {
+		t := time.NewTimer(b.linger)
+		defer t.Stop()
+		timeout = t.C
+	}
+	for len(skins) < bufferBatch {
+		select {
+		case skin := <-b.skins:
+			skins = append(skins, skin)
+			continue
+		default:
+		}
+		if timeout == nil {
+			break
+		}
+		select {
+		case skin := <-b.skins:
+			skins = append(skins, skin)
+		case <-timeout:
+			timeout = nil
+		case <-b.closing:
+			timeout = nil
+		}
+	}
+	return skins
+}
+
+func (b *bufferSink) send(skins []*QueuedSkin) error {
+	if batch, ok := b.inner.(batchSink); ok {
+		return batch.SendBatch(b.ctx, skins)
+	}
+	return b.inner.Send(b.ctx, skins[0])
+}
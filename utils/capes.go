@@ -0,0 +1,197 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"sort"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// CapeCatalogConfig configures the cape catalog
+type CapeCatalogConfig struct {
+	// File the catalog is saved to, empty disables it
+	File string
+	// OmitKnown publishes capes that were already sent as a CapeRef instead of the image,
+	// the consumer resolves them with its own catalog
+	OmitKnown bool
+	// ResendAfter is how long after sending a cape in full it is sent as a CapeRef,
+	// so a consumer that missed the image gets it again. defaults to 24h
+	ResendAfter time.Duration
+}
+
+// CatalogCape is one distinct cape
+type CatalogCape struct {
+	ID          string
+	Width       uint32
+	Height      uint32
+	Data        string
+	FirstSeen   int64
+	FirstServer string
+	// LastSent is when the image was last published in full
+	LastSent int64 `json:",omitempty"`
+	// xuid -> last seen
+	Players map[string]int64
+}
+
+// CapeCatalog records every distinct cape once and who wears it
+type CapeCatalog struct {
+	config CapeCatalogConfig
+	file   *catalogFile
+	capes  map[string]*CatalogCape
+}
+
+// OpenCapeCatalog loads the catalog from config.File
+func OpenCapeCatalog(config CapeCatalogConfig) (*CapeCatalog, error) {
+	if config.ResendAfter == 0 {
+		config.ResendAfter = 24 * time.Hour
+	}
+	c := &CapeCatalog{
+		config: config,
+		file:   &catalogFile{name: "cape catalog", file: config.File},
+		capes:  make(map[string]*CatalogCape),
+	}
+	if err := c.file.open(&c.capes); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// CapeKey is the id a cape is cataloged under, CapeID if the client sent one, otherwise the hash of the image
+func CapeKey(skin *JsonSkinData) string {
+	if skin.CapeID != "" {
+		return skin.CapeID
+	}
+	sum := sha256.Sum256([]byte(skin.CapeData))
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+func hasCape(skin *JsonSkinData) bool {
+	return skin.CapeData != "" && skin.CapeImageWidth > 0
+}
+
+// Record adds the cape of this skin to the catalog, returns its key and if it was known before
+func (c *CapeCatalog) Record(skin *QueuedSkin) (key string, known bool) {
+	if skin.Skin == nil || !hasCape(skin.Skin) {
+		return "", false
+	}
+	key = CapeKey(skin.Skin)
+
+	c.file.lock.Lock()
+	defer c.file.lock.Unlock()
+	cape, known := c.capes[key]
+	if !known {
+		cape = &CatalogCape{
+			ID:          key,
+			Width:       skin.Skin.CapeImageWidth,
+			Height:      skin.Skin.CapeImageHeight,
+			Data:        skin.Skin.CapeData,
+			FirstSeen:   skin.Time,
+			FirstServer: skin.ServerAddress,
+			Players:     make(map[string]int64),
+		}
+		c.capes[key] = cape
+		logrus.Debugf("New cape %s on %s", key, skin.ServerAddress)
+	}
+	cape.Players[skin.Xuid] = skin.Time
+	c.file.dirty = true
+	return key, known
+}
+
+// Reference records the cape and sets CapeRef if the image was sent within ResendAfter,
+// the queue then leaves the image out
+func (c *CapeCatalog) Reference(skin *QueuedSkin) {
+	key, _ := c.Record(skin)
+	if key == "" || !c.config.OmitKnown {
+		return
+	}
+
+	c.file.lock.Lock()
+	defer c.file.lock.Unlock()
+	cape := c.capes[key]
+	if cape.LastSent > 0 && skin.Time-cape.LastSent < int64(c.config.ResendAfter/time.Second) {
+		skin.CapeRef = key
+		return
+	}
+	cape.LastSent = skin.Time
+}
+
+// Resolve fills in the cape image of a skin that only has a CapeRef and records the cape,
+// returns false if the cape is not in this catalog
+func (c *CapeCatalog) Resolve(skin *QueuedSkin) bool {
+	if skin.CapeRef == "" {
+		c.Record(skin)
+		return true
+	}
+
+	c.file.lock.Lock()
+	cape, ok := c.capes[skin.CapeRef]
+	c.file.lock.Unlock()
+	if !ok || skin.Skin == nil {
+		return false
+	}
+	resolved := *skin.Skin
+	resolved.CapeData = cape.Data
+	resolved.CapeImageWidth = cape.Width
+	resolved.CapeImageHeight = cape.Height
+	skin.Skin = &resolved
+	skin.CapeRef = ""
+	c.Record(skin)
+	return true
+}
+
+// withoutCapeImage leaves out the cape image of a skin with a CapeRef
+func withoutCapeImage(skin *QueuedSkin) *QueuedSkin {
+	if skin.CapeRef == "" || skin.Skin == nil || skin.Skin.CapeData == "" {
+		return skin
+	}
+	stripped_skin := *skin.Skin
+	stripped_skin.CapeData = ""
+	stripped := *skin
+	stripped.Skin = &stripped_skin
+	return &stripped
+}
+
+// CapeSummary is a cape without its image
+type CapeSummary struct {
+	ID          string
+	FirstSeen   time.Time
+	FirstServer string
+	Players     int
+}
+
+// List returns all capes, most worn first
+func (c *CapeCatalog) List() []CapeSummary {
+	c.file.lock.Lock()
+	defer c.file.lock.Unlock()
+	ret := make([]CapeSummary, 0, len(c.capes))
+	for _, cape := range c.capes {
+		ret = append(ret, CapeSummary{
+			ID:          cape.ID,
+			FirstSeen:   time.Unix(cape.FirstSeen, 0),
+			FirstServer: cape.FirstServer,
+			Players:     len(cape.Players),
+		})
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Players > ret[j].Players
+	})
+	return ret
+}
+
+// Image returns the decoded image of a cape
+func (cape *CatalogCape) Image() ([]byte, error) {
+	return base64.RawStdEncoding.DecodeString(cape.Data)
+}
+
+// Save writes the catalog if it changed
+func (c *CapeCatalog) Save() error {
+	return c.file.save(c.capes)
+}
+
+// Close saves the catalog and stops saving it
+func (c *CapeCatalog) Close() error {
+	return c.file.close(c.capes)
+}
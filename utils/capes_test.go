@@ -0,0 +1,127 @@
+package utils_test
+
+import (
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bedrockteam/skin-bot/utils"
+	"github.com/bedrockteam/skin-bot/utils/apitest"
+)
+
+func openCapes(t *testing.T, config utils.CapeCatalogConfig) *utils.CapeCatalog {
+	config.File = filepath.Join(t.TempDir(), "capes.json")
+	c, err := utils.OpenCapeCatalog(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func capeSkin(n int, t int64) *utils.QueuedSkin {
+	skin := testSkin(n)
+	skin.Time = t
+	skin.Skin.CapeID = "cape1"
+	skin.Skin.CapeData = "BBBBBB"
+	skin.Skin.CapeImageWidth = 1
+	skin.Skin.CapeImageHeight = 1
+	return skin
+}
+
+// a cape is sent in full once, then as a CapeRef until ResendAfter
+func TestCapeReference(t *testing.T) {
+	capes := openCapes(t, utils.CapeCatalogConfig{OmitKnown: true, ResendAfter: time.Hour})
+	now := time.Now().Unix()
+	for i, c := range []struct {
+		time int64
+		ref  bool
+	}{
+		{now, false},
+		{now + 60, true},
+		{now + 2*3600, false},
+		{now + 2*3600 + 60, true},
+	} {
+		skin := capeSkin(i, c.time)
+		capes.Reference(skin)
+		if (skin.CapeRef != "") != c.ref {
+			t.Errorf("skin %d: CapeRef is %q", i, skin.CapeRef)
+		}
+	}
+}
+
+// the queue leaves out the image of a referenced cape and the consumer fills it in again
+func TestCapeRefThroughQueue(t *testing.T) {
+	broker := apitest.NewBroker()
+	q := openQueue(t, broker, utils.QueueConfig{Encoding: utils.FormatJson, Compression: utils.CompressionNone})
+	publisher := openCapes(t, utils.CapeCatalogConfig{OmitKnown: true})
+	consumer := openCapes(t, utils.CapeCatalogConfig{})
+
+	now := time.Now().Unix()
+	for i := 0; i < 3; i++ {
+		skin := capeSkin(i, now)
+		if i == 2 {
+			skin.Skin.CapeID, skin.Skin.CapeData, skin.Skin.CapeImageWidth = "", "", 0
+		}
+		publisher.Reference(skin)
+		if err := q.PublishSkin(context.Background(), skin); err != nil {
+			t.Fatal(err)
+		}
+		if skin.Skin.CapeData == "" && i < 2 {
+			t.Fatal("publishing changed the skin")
+		}
+	}
+
+	published := broker.Published()
+	for i, want := range []struct {
+		version int
+		cape    string
+		ref     string
+	}{
+		{1, "BBBBBB", ""},
+		{2, "", "cape1"},
+		{1, "", ""},
+	} {
+		var body struct {
+			Version int
+			CapeRef string
+			Skin    struct{ CapeData string }
+		}
+		if err := json.Unmarshal(published[i].Publishing.Body, &body); err != nil {
+			t.Fatal(err)
+		}
+		if body.Version != want.version || body.Skin.CapeData != want.cape || body.CapeRef != want.ref {
+			t.Errorf("message %d: version %d, cape %q, ref %q", i, body.Version, body.Skin.CapeData, body.CapeRef)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	got := make(chan *utils.QueuedSkin, 3)
+	go q.ConsumeSkins(ctx, func(ctx context.Context, skin *utils.QueuedSkin) error {
+		if !consumer.Resolve(skin) {
+			t.Errorf("cape %s of %s is unknown", skin.CapeRef, skin.Username)
+		}
+		got <- skin
+		return nil
+	})
+	for i := 0; i < 3; i++ {
+		skin := <-got
+		if skin.Username == "player1" && (skin.Skin.CapeData != "BBBBBB" || skin.CapeRef != "") {
+			t.Errorf("cape of player1 wasnt resolved: %q %q", skin.Skin.CapeData, skin.CapeRef)
+		}
+	}
+	if list := consumer.List(); len(list) != 1 || list[0].Players != 2 {
+		t.Errorf("consumer catalog is %+v", list)
+	}
+
+	// a consumer that never saw the image cant resolve it
+	skin := capeSkin(5, now)
+	skin.CapeRef = "cape1"
+	skin.Skin.CapeData = ""
+	if openCapes(t, utils.CapeCatalogConfig{}).Resolve(skin) {
+		t.Error("resolved an unknown cape")
+	}
+}
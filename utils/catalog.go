@@ -0,0 +1,82 @@
+package utils
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// catalogFile is a catalog that is kept in memory and saved to a json file every minute
+type catalogFile struct {
+	name  string
+	file  string
+	lock  sync.Mutex
+	dirty bool
+	done  chan struct{}
+}
+
+// open loads the file into v and starts saving v
+func (c *catalogFile) open(v any) error {
+	c.done = make(chan struct{})
+	data, err := os.ReadFile(c.file)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, v); err != nil {
+			return err
+		}
+	}
+
+	go func() {
+		t := time.NewTicker(1 * time.Minute)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				if err := c.save(v); err != nil {
+					logrus.Warnf("Failed to save %s %s", c.name, err)
+				}
+			case <-c.done:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// save writes v if it changed
+func (c *catalogFile) save(v any) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if !c.dirty {
+		return nil
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(c.file, data); err != nil {
+		return err
+	}
+	c.dirty = false
+	return nil
+}
+
+// close stops saving and saves v a last time
+func (c *catalogFile) close(v any) error {
+	close(c.done)
+	return c.save(v)
+}
+
+// writeFileAtomic writes data to a temp file and renames it to name
+func writeFileAtomic(name string, data []byte) error {
+	tmp := name + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, name)
+}
@@ -0,0 +1,67 @@
+package utils
+
+import (
+	"sync"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// confirmTracker matches publisher confirms of one channel to the publishes waiting for them
+type confirmTracker struct {
+	lock    sync.Mutex
+	pending map[uint64]chan bool
+	closed  bool
+}
+
+// newConfirmTracker puts the channel in confirm mode and starts tracking its confirms
+func newConfirmTracker(ch AMQPChannel) (*confirmTracker, error) {
+	if err := ch.Confirm(false); err != nil {
+		return nil, err
+	}
+	t := &confirmTracker{
+		pending: make(map[uint64]chan bool),
+	}
+	confirms := ch.NotifyPublish(make(chan amqp.Confirmation, 128))
+	go t.run(confirms)
+	return t, nil
+}
+
+func (t *confirmTracker) run(confirms chan amqp.Confirmation) {
+	for c := range confirms {
+		t.lock.Lock()
+		if wait, ok := t.pending[c.DeliveryTag]; ok {
+			wait <- c.Ack
+			delete(t.pending, c.DeliveryTag)
+		}
+		t.lock.Unlock()
+	}
+
+	// the channel closed, nothing pending will be confirmed anymore
+	t.lock.Lock()
+	for tag, wait := range t.pending {
+		wait <- false
+		delete(t.pending, tag)
+	}
+	t.closed = true
+	t.lock.Unlock()
+}
+
+// expect registers a publish with this delivery tag, the returned channel receives if it was acked
+func (t *confirmTracker) expect(tag uint64) chan bool {
+	wait := make(chan bool, 1)
+	t.lock.Lock()
+	if t.closed {
+		wait <- false
+	} else {
+		t.pending[tag] = wait
+	}
+	t.lock.Unlock()
+	return wait
+}
+
+// forget stops waiting for a tag
+func (t *confirmTracker) forget(tag uint64) {
+	t.lock.Lock()
+	delete(t.pending, tag)
+	t.lock.Unlock()
+}
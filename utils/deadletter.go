@@ -0,0 +1,168 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/sirupsen/logrus"
+)
+
+// PoisonError marks a skin that will never be processed, ConsumeSkins dead letters it instead of requeueing it
+type PoisonError struct {
+	Err error
+}
+
+func (e *PoisonError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *PoisonError) Unwrap() error {
+	return e.Err
+}
+
+const (
+	// deadLetterReasonHeader holds why a skin was dead lettered
+	deadLetterReasonHeader = "x-skin-bot-error"
+	// deadLetterQueueHeader holds the queue a skin was dead lettered from
+	deadLetterQueueHeader = "x-skin-bot-queue"
+)
+
+// deadLetter copies a delivery to the dead letter queue with the reason it failed.
+// rejecting it to the dead letter exchange of the queue would lose the reason, that one only
+// catches the skins the broker drops, see TopologyConfig.DeadLetterExchange.
+func (q *MQ) deadLetter(ctx context.Context, current *mqChannel, d *amqp.Delivery, reason error) error {
+	return q.publishConfirmed(ctx, current, "", q.dead_letter, q.deadLetterPublishing(d, d.Body, d.ContentType, reason))
+}
+
+// deadLetterSkin puts one skin of a batch in the dead letter queue on its own
+func (q *MQ) deadLetterSkin(ctx context.Context, current *mqChannel, d *amqp.Delivery, skin *QueuedSkin, reason error) error {
+	body, content_type, err := EncodeSkin(skin, q.encoding)
+	if err != nil {
+		return err
+	}
+	publishing := q.deadLetterPublishing(d, body, content_type, reason)
+	// the signature was for the whole batch
+	delete(publishing.Headers, keyIdHeader)
+	delete(publishing.Headers, signatureHeader)
+	delete(publishing.Headers, encryptedHeader)
+	if err := q.signer.seal(&publishing); err != nil {
+		return err
+	}
+	return q.publishConfirmed(ctx, current, "", q.dead_letter, publishing)
+}
+
+// deadLetterPublishing copies the properties of d to a message for the dead letter queue
+func (q *MQ) deadLetterPublishing(d *amqp.Delivery, body []byte, content_type string, reason error) amqp.Publishing {
+	headers := amqp.Table{}
+	for k, v := range d.Headers {
+		headers[k] = v
+	}
+	headers[deadLetterReasonHeader] = reason.Error()
+	headers[deadLetterQueueHeader] = q.topology.Queue
+
+	return amqp.Publishing{
+		Headers:         headers,
+		ContentType:     content_type,
+		ContentEncoding: d.ContentEncoding,
+		MessageId:       d.MessageId,
+		Timestamp:       d.Timestamp,
+		AppId:           d.AppId,
+		Body:            body,
+	}
+}
+
+// DeadLetter is a skin in the dead letter queue
+type DeadLetter struct {
+	Reason      string
+	Queue       string
+	ContentType string
+	MessageId   string
+	Size        int
+}
+
+// RequeueDeadLetters moves up to limit skins from the dead letter queue back to the skin queue,
+// limit <= 0 moves all of them. it returns how many were moved.
+func (q *MQ) RequeueDeadLetters(ctx context.Context, limit int) (int, error) {
+	current, err := q.connected(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for limit <= 0 || count < limit {
+		if ctx.Err() != nil {
+			return count, ctx.Err()
+		}
+		d, ok, err := current.channel.Get(q.dead_letter, false)
+		if err != nil {
+			return count, err
+		}
+		if !ok {
+			break
+		}
+
+		headers := amqp.Table{}
+		for k, v := range d.Headers {
+			headers[k] = v
+		}
+		delete(headers, deadLetterReasonHeader)
+		delete(headers, deadLetterQueueHeader)
+		err = q.publishConfirmed(ctx, current, "", current.skin_queue.Name, amqp.Publishing{
+			Headers:         headers,
+			ContentType:     d.ContentType,
+			ContentEncoding: d.ContentEncoding,
+			MessageId:       d.MessageId,
+			Timestamp:       d.Timestamp,
+			AppId:           d.AppId,
+			Body:            d.Body,
+		})
+		if err != nil {
+			d.Nack(false, true)
+			return count, fmt.Errorf("requeue: %s", err)
+		}
+		if err := d.Ack(false); err != nil {
+			return count, err
+		}
+		count++
+	}
+	logrus.Infof("Requeued %d dead skins", count)
+	return count, nil
+}
+
+// ListDeadLetters returns up to limit skins in the dead letter queue without removing them
+func (q *MQ) ListDeadLetters(ctx context.Context, limit int) ([]DeadLetter, error) {
+	current, err := q.connected(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var ret []DeadLetter
+	var last uint64
+	for limit <= 0 || len(ret) < limit {
+		d, ok, err := current.channel.Get(q.dead_letter, false)
+		if err != nil {
+			return ret, err
+		}
+		if !ok {
+			break
+		}
+		last = d.DeliveryTag
+		reason, _ := d.Headers[deadLetterReasonHeader].(string)
+		queue, _ := d.Headers[deadLetterQueueHeader].(string)
+		ret = append(ret, DeadLetter{
+			Reason:      reason,
+			Queue:       queue,
+			ContentType: d.ContentType,
+			MessageId:   d.MessageId,
+			Size:        len(d.Body),
+		})
+	}
+	if last != 0 {
+		// put them all back in the same order
+		if err := current.channel.Nack(last, true, true); err != nil {
+			return ret, err
+		}
+	}
+	return ret, nil
+}
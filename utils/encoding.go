@@ -0,0 +1,316 @@
+package utils
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// message body formats
+const (
+	FormatJson     = "json"
+	FormatProtobuf = "protobuf"
+)
+
+// message body compressions
+const (
+	CompressionNone = "none"
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+)
+
+// MessageEncoding describes how a QueuedSkin is written to a message body
+type MessageEncoding struct {
+	Format      string
+	Compression string
+}
+
+type contentTypeInfo struct {
+	format      string
+	compression string
+	// the body holds several skins
+	batch bool
+}
+
+// content type -> encoding
+var contentTypes = map[string]contentTypeInfo{
+	"":                                       {FormatJson, CompressionNone, false}, // old publishers didnt set one
+	"application/json":                       {FormatJson, CompressionNone, false},
+	"application/json-gz":                    {FormatJson, CompressionGzip, false},
+	"application/json-zstd":                  {FormatJson, CompressionZstd, false},
+	"application/x-protobuf":                 {FormatProtobuf, CompressionNone, false},
+	"application/x-protobuf-gz":              {FormatProtobuf, CompressionGzip, false},
+	"application/x-protobuf-zstd":            {FormatProtobuf, CompressionZstd, false},
+	"application/x-skin-batch-json":          {FormatJson, CompressionNone, true},
+	"application/x-skin-batch-json-gz":       {FormatJson, CompressionGzip, true},
+	"application/x-skin-batch-json-zstd":     {FormatJson, CompressionZstd, true},
+	"application/x-skin-batch-protobuf":      {FormatProtobuf, CompressionNone, true},
+	"application/x-skin-batch-protobuf-gz":   {FormatProtobuf, CompressionGzip, true},
+	"application/x-skin-batch-protobuf-zstd": {FormatProtobuf, CompressionZstd, true},
+}
+
+// withDefaults fills in the encoding used before it was configurable
+func (e MessageEncoding) withDefaults() MessageEncoding {
+	if e.Format == "" {
+		e.Format = FormatJson
+	}
+	if e.Compression == "" {
+		e.Compression = CompressionGzip
+	}
+	return e
+}
+
+// ContentType returns the amqp content type for this encoding
+func (e MessageEncoding) ContentType() (string, error) {
+	return e.contentType(false)
+}
+
+// BatchContentType returns the amqp content type for a batch of skins with this encoding
+func (e MessageEncoding) BatchContentType() (string, error) {
+	return e.contentType(true)
+}
+
+func (e MessageEncoding) contentType(batch bool) (string, error) {
+	e = e.withDefaults()
+	for ct, info := range contentTypes {
+		if ct != "" && info.format == e.Format && info.compression == e.Compression && info.batch == batch {
+			return ct, nil
+		}
+	}
+	return "", fmt.Errorf("unsupported encoding %s/%s", e.Format, e.Compression)
+}
+
+var (
+	zstd_encoder     *zstd.Encoder
+	zstd_decoder     *zstd.Decoder
+	zstd_init        sync.Once
+	zstd_init_err    error
+	zstd_max_decoded = uint64(64 << 20)
+)
+
+func initZstd() error {
+	zstd_init.Do(func() {
+		zstd_encoder, zstd_init_err = zstd.NewWriter(nil)
+		if zstd_init_err != nil {
+			return
+		}
+		zstd_decoder, zstd_init_err = zstd.NewReader(nil, zstd.WithDecoderMaxMemory(zstd_max_decoded))
+	})
+	return zstd_init_err
+}
+
+func compress(compression string, data []byte) ([]byte, error) {
+	switch compression {
+	case CompressionNone:
+		return data, nil
+	case CompressionGzip:
+		buf := bytes.NewBuffer(nil)
+		w := gzip.NewWriter(buf)
+		if _, err := w.Write(data); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case CompressionZstd:
+		if err := initZstd(); err != nil {
+			return nil, err
+		}
+		return zstd_encoder.EncodeAll(data, nil), nil
+	}
+	return nil, fmt.Errorf("unsupported compression %s", compression)
+}
+
+func decompress(compression string, data []byte) ([]byte, error) {
+	switch compression {
+	case CompressionNone:
+		return data, nil
+	case CompressionGzip:
+		r, err := gzip.NewReader(bytes.NewBuffer(data))
+		if err != nil {
+			return nil, err
+		}
+		// the same cap as zstd, a small body must not inflate without limit
+		decoded, err := io.ReadAll(io.LimitReader(r, int64(zstd_max_decoded)+1))
+		if err != nil {
+			return nil, err
+		}
+		if uint64(len(decoded)) > zstd_max_decoded {
+			return nil, fmt.Errorf("gzip body is larger than %d bytes", zstd_max_decoded)
+		}
+		return decoded, nil
+	case CompressionZstd:
+		if err := initZstd(); err != nil {
+			return nil, err
+		}
+		return zstd_decoder.DecodeAll(data, nil)
+	}
+	return nil, fmt.Errorf("unsupported compression %s", compression)
+}
+
+// EncodeSkin encodes a skin to a message body, returns the body and its content type
+func EncodeSkin(skin *QueuedSkin, enc MessageEncoding) ([]byte, string, error) {
+	enc = enc.withDefaults()
+	content_type, err := enc.ContentType()
+	if err != nil {
+		return nil, "", err
+	}
+	body, err := encodeSkinBody(skin, enc.Format)
+	if err != nil {
+		return nil, "", err
+	}
+	body, err = compress(enc.Compression, body)
+	if err != nil {
+		return nil, "", err
+	}
+	return body, content_type, nil
+}
+
+// encodeSkinBody encodes a skin without compressing it
+func encodeSkinBody(skin *QueuedSkin, format string) ([]byte, error) {
+	if skin.Version < 1 || skin.Version > SchemaVersion {
+		return nil, fmt.Errorf("cant encode skin with schema version %d", skin.Version)
+	}
+	if skin.Version == 2 && skin.CapeRef == "" {
+		// without a CapeRef it is a version 1 skin, consumers from before version 2 can read it
+		v1 := *skin
+		v1.Version = 1
+		skin = &v1
+	}
+
+	switch format {
+	case FormatJson:
+		return json.Marshal(skin)
+	case FormatProtobuf:
+		return skin.MarshalProto()
+	}
+	return nil, fmt.Errorf("unsupported format %s", format)
+}
+
+// EncodeSkinBatch encodes several skins to one message body, returns the body and its content type.
+// a json batch is an array of skins, a protobuf batch is a SkinBatch.
+func EncodeSkinBatch(skins []*QueuedSkin, enc MessageEncoding) ([]byte, string, error) {
+	enc = enc.withDefaults()
+	bodies := make([][]byte, 0, len(skins))
+	for _, skin := range skins {
+		body, err := encodeSkinBody(skin, enc.Format)
+		if err != nil {
+			return nil, "", err
+		}
+		bodies = append(bodies, body)
+	}
+	return encodeBatch(bodies, enc)
+}
+
+// encodeBatch joins skins encoded with encodeSkinBody and compresses them
+func encodeBatch(bodies [][]byte, enc MessageEncoding) ([]byte, string, error) {
+	enc = enc.withDefaults()
+	content_type, err := enc.BatchContentType()
+	if err != nil {
+		return nil, "", err
+	}
+
+	var body []byte
+	switch enc.Format {
+	case FormatJson:
+		body = append(body, '[')
+		for i, b := range bodies {
+			if i > 0 {
+				body = append(body, ',')
+			}
+			body = append(body, b...)
+		}
+		body = append(body, ']')
+	case FormatProtobuf:
+		w := &protoWriter{}
+		for _, b := range bodies {
+			w.message(1, b)
+		}
+		body = w.b
+	}
+
+	body, err = compress(enc.Compression, body)
+	if err != nil {
+		return nil, "", err
+	}
+	return body, content_type, nil
+}
+
+// DecodeSkin decodes a message body with the given content type to a skin of the current SchemaVersion
+func DecodeSkin(content_type string, body []byte) (*QueuedSkin, error) {
+	info, ok := contentTypes[content_type]
+	if !ok {
+		return nil, fmt.Errorf("unsupported content type %q", content_type)
+	}
+	if info.batch {
+		return nil, fmt.Errorf("%s is a batch, use DecodeSkins", content_type)
+	}
+
+	body, err := decompress(info.compression, body)
+	if err != nil {
+		return nil, err
+	}
+
+	return decodeVersioned(info.format, body)
+}
+
+// DecodeSkins decodes a message body that holds one skin or a batch of them
+func DecodeSkins(content_type string, body []byte) ([]*QueuedSkin, error) {
+	info, ok := contentTypes[content_type]
+	if !ok {
+		return nil, fmt.Errorf("unsupported content type %q", content_type)
+	}
+
+	body, err := decompress(info.compression, body)
+	if err != nil {
+		return nil, err
+	}
+	if !info.batch {
+		skin, err := decodeVersioned(info.format, body)
+		if err != nil {
+			return nil, err
+		}
+		return []*QueuedSkin{skin}, nil
+	}
+
+	var bodies [][]byte
+	switch info.format {
+	case FormatJson:
+		var raw []json.RawMessage
+		if err := json.Unmarshal(body, &raw); err != nil {
+			return nil, err
+		}
+		for _, r := range raw {
+			bodies = append(bodies, r)
+		}
+	case FormatProtobuf:
+		err := protoFields(body, func(num protowire.Number, typ protowire.Type, b []byte) int {
+			if num != 1 || typ != protowire.BytesType {
+				return 0
+			}
+			data, n := protowire.ConsumeBytes(b)
+			bodies = append(bodies, data)
+			return n
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	skins := make([]*QueuedSkin, 0, len(bodies))
+	for i, b := range bodies {
+		skin, err := decodeVersioned(info.format, b)
+		if err != nil {
+			return nil, fmt.Errorf("batch skin %d: %s", i, err)
+		}
+		skins = append(skins, skin)
+	}
+	return skins, nil
+}
@@ -0,0 +1,150 @@
+package utils_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/bedrockteam/skin-bot/utils"
+	"github.com/sandertv/gophertunnel/minecraft/protocol"
+)
+
+// benchSkin is a 64x64 skin with a cape, the image is mostly flat colour like real skins.
+// skins with different n differ so batches dont compress better than real ones
+func benchSkin(n int) *utils.QueuedSkin {
+	r := rand.New(rand.NewSource(int64(n)))
+	image := make([]byte, 64*64*4)
+	for i := 0; i < len(image); i += 4 {
+		if r.Intn(8) == 0 {
+			r.Read(image[i : i+3])
+		} else if i > 0 {
+			copy(image[i:i+3], image[i-4:i-1])
+		}
+		image[i+3] = 0xff
+	}
+	cape := make([]byte, 64*32*4)
+	copy(cape, image)
+
+	skin := testSkin(n)
+	skin.Skin.SkinData = base64.RawStdEncoding.EncodeToString(image)
+	skin.Skin.CapeData = base64.RawStdEncoding.EncodeToString(cape)
+	skin.Skin.CapeImageWidth, skin.Skin.CapeImageHeight = 64, 32
+	skin.Skin.SkinResourcePatch = base64.RawStdEncoding.EncodeToString([]byte(`{"geometry":{"default":"geometry.humanoid.custom"}}`))
+	return skin
+}
+
+var benchEncodings = []utils.MessageEncoding{
+	{Format: utils.FormatJson, Compression: utils.CompressionNone},
+	{Format: utils.FormatJson, Compression: utils.CompressionGzip},
+	{Format: utils.FormatJson, Compression: utils.CompressionZstd},
+	{Format: utils.FormatProtobuf, Compression: utils.CompressionNone},
+	{Format: utils.FormatProtobuf, Compression: utils.CompressionGzip},
+	{Format: utils.FormatProtobuf, Compression: utils.CompressionZstd},
+}
+
+func BenchmarkEncodeSkin(b *testing.B) {
+	skin := benchSkin(1)
+	for _, enc := range benchEncodings {
+		b.Run(enc.Format+"/"+enc.Compression, func(b *testing.B) {
+			var size int
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				body, _, err := utils.EncodeSkin(skin, enc)
+				if err != nil {
+					b.Fatal(err)
+				}
+				size = len(body)
+			}
+			b.ReportMetric(float64(size), "bytes/skin")
+		})
+	}
+}
+
+func BenchmarkDecodeSkin(b *testing.B) {
+	skin := benchSkin(1)
+	for _, enc := range benchEncodings {
+		b.Run(enc.Format+"/"+enc.Compression, func(b *testing.B) {
+			body, content_type, err := utils.EncodeSkin(skin, enc)
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := utils.DecodeSkins(content_type, body); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(len(body)), "bytes/skin")
+		})
+	}
+}
+
+// encoding and decoding again has to give the same skin for every encoding
+func TestEncodeSkinRoundTrip(t *testing.T) {
+	skin := benchSkin(1)
+	skin.Version = 1
+	skin.Message = nil
+	skin.Skin.Animations = []utils.Skin_anim{{
+		ImageWidth:     32,
+		ImageHeight:    64,
+		ImageData:      skin.Skin.SkinData[:64],
+		AnimationType:  1,
+		FrameCount:     2.5,
+		ExpressionType: 1,
+	}}
+	skin.Skin.PersonaSkin = true
+	skin.Skin.PersonaPieces = []protocol.PersonaPiece{{
+		PieceID:   "piece-id",
+		PieceType: "persona_eyes",
+		PackID:    "pack-id",
+		Default:   true,
+	}}
+	skin.Skin.PieceTintColours = []protocol.PersonaPieceTintColour{{
+		PieceType: "persona_eyes",
+		Colours:   []string{"#ffa12722", "#ff2f1f0f", "#ff3aafd9", "#0"},
+	}}
+	for _, enc := range benchEncodings {
+		body, content_type, err := utils.EncodeSkin(skin, enc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		skins, err := utils.DecodeSkins(content_type, body)
+		if err != nil {
+			t.Fatalf("%s: %s", content_type, err)
+		}
+		if len(skins) != 1 {
+			t.Fatalf("%s: decoded %d skins", content_type, len(skins))
+		}
+		// decoding migrates to the current version
+		got := *skins[0]
+		got.Version = skin.Version
+		got.Message = nil
+		if !reflect.DeepEqual(&got, skin) {
+			t.Errorf("%s: skin changed\n got %+v\nwant %+v", content_type, got.Skin, skin.Skin)
+		}
+	}
+}
+
+// a gzip body that inflates past the limit is rejected instead of read into memory
+func TestDecodeGzipLimit(t *testing.T) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(make([]byte, 64<<20+1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	content_type, err := utils.MessageEncoding{Format: utils.FormatJson, Compression: utils.CompressionGzip}.ContentType()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := utils.DecodeSkins(content_type, buf.Bytes()); err == nil || !strings.Contains(err.Error(), "larger than") {
+		t.Errorf("decoding a gzip bomb gave %v", err)
+	}
+}
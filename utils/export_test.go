@@ -0,0 +1,22 @@
+package utils
+
+import (
+	"net/http"
+	"time"
+)
+
+// SetRetryDelays shortens how long queues wait before reconnecting and retrying publishes
+func SetRetryDelays(reconnect, publish time.Duration) {
+	reconnectDelay = reconnect
+	publishRetryDelay = publish
+}
+
+// SetRoutesRetryDelay shortens the wait between failed route fetches
+func SetRoutesRetryDelay(d time.Duration) {
+	routesRetryDelay = d
+}
+
+// SignRequest signs req like a client with SignRequests does
+func SignRequest(req *http.Request, key_id string, key []byte) error {
+	return signRequest(req, key_id, key)
+}
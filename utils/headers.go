@@ -0,0 +1,124 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// AppId is the AppId property of every published skin
+const AppId = "skin-bot"
+
+// headers of published skins
+const (
+	nodeIdHeader        = "x-skin-bot-node-id"
+	accountHeader       = "x-skin-bot-account"
+	serverHeader        = "x-skin-bot-server"
+	serverIPHeader      = "x-skin-bot-server-ip"
+	schemaVersionHeader = "x-skin-bot-schema-version"
+)
+
+// MessageInfo is what the properties and headers of a skin message say about it.
+// consumers get it without decoding the body, batches share one.
+type MessageInfo struct {
+	// MessageId is the sha256 of the encoded body before it is encrypted, the same skins keep it when they are published again
+	MessageId string
+	Timestamp time.Time
+	AppId     string
+	// NodeId is the node_id of the skin-bot that published the skin
+	NodeId string
+	// Account is the name of the bot account that saw the skin
+	Account string
+	// Server is the address from the server list
+	Server string
+	// IP is the instance of Server the bot was connected to
+	IP            string
+	SchemaVersion int
+}
+
+// splitServerAddress splits the "<server> <ip>" the bots put in ServerAddress
+func splitServerAddress(address string) (server, ip string) {
+	server, ip, _ = strings.Cut(address, " ")
+	return server, ip
+}
+
+// publishing builds the amqp message for skins encoded to body, values that
+// differ between the skins of a batch are left out
+func (q *MQ) publishing(skins []*QueuedSkin, body []byte, content_type string) amqp.Publishing {
+	sum := sha256.Sum256(body)
+	headers := amqp.Table{
+		schemaVersionHeader: int32(SchemaVersion),
+	}
+	if q.node_id != "" {
+		headers[nodeIdHeader] = q.node_id
+	}
+
+	var timestamp int64
+	var account, server, ip string
+	for i, skin := range skins {
+		s, p := splitServerAddress(skin.ServerAddress)
+		a := ""
+		if skin.Message != nil {
+			a = skin.Message.Account
+			if skin.Message.IP != "" {
+				p = skin.Message.IP
+			}
+		}
+		if i == 0 {
+			account, server, ip = a, s, p
+		}
+		if a != account {
+			account = ""
+		}
+		if s != server {
+			server = ""
+		}
+		if p != ip {
+			ip = ""
+		}
+		if skin.Time > timestamp {
+			timestamp = skin.Time
+		}
+	}
+	for k, v := range map[string]string{accountHeader: account, serverHeader: server, serverIPHeader: ip} {
+		if v != "" {
+			headers[k] = v
+		}
+	}
+
+	return amqp.Publishing{
+		Headers:     headers,
+		ContentType: content_type,
+		MessageId:   hex.EncodeToString(sum[:]),
+		Timestamp:   time.Unix(timestamp, 0),
+		AppId:       AppId,
+		Body:        body,
+	}
+}
+
+// messageInfo reads the properties and headers of a delivery
+func messageInfo(d *amqp.Delivery) *MessageInfo {
+	info := &MessageInfo{
+		MessageId: d.MessageId,
+		Timestamp: d.Timestamp,
+		AppId:     d.AppId,
+	}
+	info.NodeId, _ = d.Headers[nodeIdHeader].(string)
+	info.Account, _ = d.Headers[accountHeader].(string)
+	info.Server, _ = d.Headers[serverHeader].(string)
+	info.IP, _ = d.Headers[serverIPHeader].(string)
+	switch v := d.Headers[schemaVersionHeader].(type) {
+	case int32:
+		info.SchemaVersion = int(v)
+	case int64:
+		info.SchemaVersion = int(v)
+	case int16:
+		info.SchemaVersion = int(v)
+	case int8:
+		info.SchemaVersion = int(v)
+	}
+	return info
+}
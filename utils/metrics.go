@@ -0,0 +1,62 @@
+package utils
+
+import "github.com/prometheus/client_golang/prometheus"
+
+const metricNamespace = "skin_bot"
+
+// clientMetrics are the metrics of one Client, shared by its queues and its spool
+type clientMetrics struct {
+	publishConfirmSeconds prometheus.Histogram
+	publishFailures       *prometheus.CounterVec
+
+	spoolEntries prometheus.Gauge
+	spoolBytes   prometheus.Gauge
+	spoolDropped *prometheus.CounterVec
+}
+
+func newClientMetrics() *clientMetrics {
+	return &clientMetrics{
+		publishConfirmSeconds: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: metricNamespace,
+			Name:      "publish_confirm_seconds",
+			Help:      "How long the broker took to confirm a published skin",
+			Buckets:   prometheus.ExponentialBuckets(0.005, 2, 12),
+		}),
+		publishFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricNamespace,
+			Name:      "publish_failures_total",
+			Help:      "How many publishes failed and were retried, by reason",
+		}, []string{"reason"}),
+
+		spoolEntries: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricNamespace,
+			Name:      "spool_entries",
+			Help:      "How many skins are waiting in the spool",
+		}),
+		spoolBytes: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricNamespace,
+			Name:      "spool_bytes",
+			Help:      "Size of the spool segment files",
+		}),
+		spoolDropped: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricNamespace,
+			Name:      "spool_dropped_total",
+			Help:      "How many skins were dropped from the spool without being sent, by reason",
+		}, []string{"reason"}),
+	}
+}
+
+func (m *clientMetrics) collectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		m.publishConfirmSeconds,
+		m.publishFailures,
+		m.spoolEntries,
+		m.spoolBytes,
+		m.spoolDropped,
+	}
+}
+
+// MetricCollectors are the metrics of this client, they get pushed with the node metrics
+func (u *Client) MetricCollectors() []prometheus.Collector {
+	return u.stats.collectors()
+}
@@ -0,0 +1,150 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// NodeConfig configures how this node announces itself to the api server
+type NodeConfig struct {
+	// Register registers the node with the api server and sends heartbeats
+	Register bool
+	// Heartbeat is the time between heartbeats, defaults to 30s
+	Heartbeat time.Duration
+	// Capacity is how many bots this node can run, the api server uses it to spread work. 0 is unlimited
+	Capacity int
+}
+
+// NodeInfo is sent when the node registers
+type NodeInfo struct {
+	NodeId    string
+	Version   string
+	Accounts  []string
+	Servers   []string
+	Capacity  int
+	StartedAt int64
+}
+
+// NodeStatus is sent with every heartbeat
+type NodeStatus struct {
+	// RunningBots is the number of connected bots per server
+	RunningBots map[string]int
+	// Waitlist is the number of instances waiting to be retried
+	Waitlist int
+	Time     int64
+}
+
+// node registers and heartbeats this node
+type node struct {
+	client *Client
+	config NodeConfig
+	info   NodeInfo
+	status func() NodeStatus
+
+	lock       sync.Mutex
+	registered bool
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// StartNode registers this node and sends heartbeats with status until Close, which deregisters it
+func (u *Client) StartNode(config NodeConfig, info NodeInfo, status func() NodeStatus) {
+	if !config.Register || u.config.Server == "" {
+		return
+	}
+	if config.Heartbeat == 0 {
+		config.Heartbeat = 30 * time.Second
+	}
+	info.NodeId = u.NodeId
+	info.Capacity = config.Capacity
+
+	ctx, cancel := context.WithCancel(context.Background())
+	n := &node{
+		client: u,
+		config: config,
+		info:   info,
+		status: status,
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	u.node = n
+	if err := n.register(ctx); err != nil {
+		logrus.Warnf("Registering node: %s, retrying with the next heartbeat", err)
+	}
+	go n.run(ctx)
+}
+
+func (n *node) path() string {
+	return "/nodes/" + url.PathEscape(n.info.NodeId)
+}
+
+func (n *node) register(ctx context.Context) error {
+	if err := n.client.jsonRequest(ctx, "POST", "/nodes", n.info, nil); err != nil {
+		return err
+	}
+	n.lock.Lock()
+	n.registered = true
+	n.lock.Unlock()
+	logrus.Infof("Registered node %s", n.info.NodeId)
+	return nil
+}
+
+func (n *node) heartbeat(ctx context.Context) error {
+	n.lock.Lock()
+	registered := n.registered
+	n.lock.Unlock()
+	if !registered {
+		return n.register(ctx)
+	}
+
+	status := n.status()
+	status.Time = time.Now().Unix()
+	err := n.client.jsonRequest(ctx, "POST", n.path()+"/heartbeat", status, nil)
+	var status_err *apiStatusError
+	if errors.As(err, &status_err) && status_err.status == http.StatusNotFound {
+		// the api server forgot this node
+		return n.register(ctx)
+	}
+	return err
+}
+
+func (n *node) run(ctx context.Context) {
+	defer close(n.done)
+	t := time.NewTicker(n.config.Heartbeat)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return
+		}
+		if err := n.heartbeat(ctx); err != nil && ctx.Err() == nil {
+			logrus.Warnf("Node heartbeat: %s", err)
+		}
+	}
+}
+
+// close stops the heartbeats and deregisters the node
+func (n *node) close() {
+	n.cancel()
+	<-n.done
+
+	n.lock.Lock()
+	registered := n.registered
+	n.lock.Unlock()
+	if !registered {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := n.client.jsonRequest(ctx, "DELETE", n.path(), nil, nil); err != nil {
+		logrus.Warnf("Deregistering node: %s", err)
+	}
+}
@@ -0,0 +1,62 @@
+package utils_test
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bedrockteam/skin-bot/utils"
+	"github.com/bedrockteam/skin-bot/utils/apitest"
+)
+
+// a node registers, sends heartbeats, registers again when the api server forgot it and deregisters on Close
+func TestNodeLifecycle(t *testing.T) {
+	server := apitest.NewServer("key")
+	t.Cleanup(server.Close)
+	client, err := utils.NewClient(server.Config(), nil, utils.QueueConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.NodeId = "node1"
+	if err := client.Start(false); err != nil {
+		t.Fatal(err)
+	}
+
+	var bots atomic.Int64
+	client.StartNode(utils.NodeConfig{Register: true, Heartbeat: 10 * time.Millisecond, Capacity: 3}, utils.NodeInfo{
+		Version:  "test",
+		Accounts: []string{"bot1"},
+	}, func() utils.NodeStatus {
+		return utils.NodeStatus{RunningBots: map[string]int{"play.example.com": int(bots.Load())}}
+	})
+
+	info, ok := server.Nodes()["node1"]
+	if !ok {
+		t.Fatal("node did not register")
+	}
+	if info.Version != "test" || info.Capacity != 3 || len(info.Accounts) != 1 {
+		t.Errorf("registered as %+v", info)
+	}
+
+	bots.Store(2)
+	waitUntil(t, "a heartbeat with the running bots", func() bool {
+		status, ok := server.Heartbeat("node1")
+		return ok && status.RunningBots["play.example.com"] == 2 && status.Time != 0
+	})
+
+	// the first heartbeat after a restart of the api server registers again
+	server.ForgetNode("node1")
+	waitUntil(t, "the node registered again", func() bool {
+		_, ok := server.Nodes()["node1"]
+		return ok
+	})
+	waitUntil(t, "heartbeats after registering again", func() bool {
+		_, ok := server.Heartbeat("node1")
+		return ok
+	})
+
+	client.Close()
+	if _, ok := server.Nodes()["node1"]; ok {
+		t.Error("node is still registered after Close")
+	}
+}
@@ -54,7 +54,7 @@ func PacketLogger(header packet.Header, payload []byte, src, dst, local_addr net
 
 	defer func() {
 		if recoveredErr := recover(); recoveredErr != nil {
-			logrus.Errorf("%T: %w", pk, recoveredErr.(error))
+			logrus.Errorf("%T: %s", pk, recoveredErr.(error))
 		}
 	}()
 
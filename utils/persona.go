@@ -0,0 +1,265 @@
+package utils
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// PersonaCatalogConfig configures the persona piece catalog
+type PersonaCatalogConfig struct {
+	// File the catalog is saved to, empty disables it
+	File string
+}
+
+// CatalogPiece is one distinct persona piece
+type CatalogPiece struct {
+	PieceID   string
+	PieceType string
+	PackID    string
+	IsDefault bool
+	ProductID string
+	FirstSeen int64
+	// server -> xuid -> last seen
+	Servers map[string]map[string]int64
+}
+
+// CatalogTint is one distinct tint of a piece type
+type CatalogTint struct {
+	PieceType string
+	Colours   []string
+	// server -> xuid -> last seen
+	Servers map[string]map[string]int64
+}
+
+type personaCatalogData struct {
+	Pieces map[string]*CatalogPiece
+	Tints  map[string]*CatalogTint
+}
+
+// PersonaCatalog records the persona pieces and tints players wear per server
+type PersonaCatalog struct {
+	file *catalogFile
+	data personaCatalogData
+}
+
+// OpenPersonaCatalog loads the catalog from config.File
+func OpenPersonaCatalog(config PersonaCatalogConfig) (*PersonaCatalog, error) {
+	c := &PersonaCatalog{
+		file: &catalogFile{name: "persona catalog", file: config.File},
+		data: personaCatalogData{
+			Pieces: make(map[string]*CatalogPiece),
+			Tints:  make(map[string]*CatalogTint),
+		},
+	}
+	if err := c.file.open(&c.data); err != nil {
+		return nil, err
+	}
+	// older catalogs are keyed by the whole ServerAddress with the instance ip
+	c.file.lock.Lock()
+	for _, piece := range c.data.Pieces {
+		piece.Servers = mergeInstances(piece.Servers)
+	}
+	for _, tint := range c.data.Tints {
+		tint.Servers = mergeInstances(tint.Servers)
+	}
+	c.file.lock.Unlock()
+	return c, nil
+}
+
+// mergeInstances merges the players of the instances of a server
+func mergeInstances(servers map[string]map[string]int64) map[string]map[string]int64 {
+	merged := make(map[string]map[string]int64, len(servers))
+	for address, players := range servers {
+		server, _ := splitServerAddress(address)
+		for xuid, t := range players {
+			if last, ok := merged[server][xuid]; !ok || t > last {
+				addPlayer(merged, server, xuid, t)
+			}
+		}
+	}
+	return merged
+}
+
+func addPlayer(servers map[string]map[string]int64, server, xuid string, t int64) {
+	players, ok := servers[server]
+	if !ok {
+		players = make(map[string]int64)
+		servers[server] = players
+	}
+	players[xuid] = t
+}
+
+// Record adds the persona pieces and tints of this skin, the instances of a server count as one
+func (c *PersonaCatalog) Record(skin *QueuedSkin) {
+	if skin.Skin == nil || len(skin.Skin.PersonaPieces) == 0 {
+		return
+	}
+	server, _ := splitServerAddress(skin.ServerAddress)
+
+	c.file.lock.Lock()
+	defer c.file.lock.Unlock()
+	for _, p := range skin.Skin.PersonaPieces {
+		piece, ok := c.data.Pieces[p.PieceID]
+		if !ok {
+			piece = &CatalogPiece{
+				PieceID:   p.PieceID,
+				PieceType: p.PieceType,
+				PackID:    p.PackID,
+				IsDefault: p.Default,
+				ProductID: p.ProductID,
+				FirstSeen: skin.Time,
+				Servers:   make(map[string]map[string]int64),
+			}
+			c.data.Pieces[p.PieceID] = piece
+		}
+		addPlayer(piece.Servers, server, skin.Xuid, skin.Time)
+	}
+	for _, t := range skin.Skin.PieceTintColours {
+		key := t.PieceType + ":" + strings.Join(t.Colours, ",")
+		tint, ok := c.data.Tints[key]
+		if !ok {
+			tint = &CatalogTint{
+				PieceType: t.PieceType,
+				Colours:   t.Colours,
+				Servers:   make(map[string]map[string]int64),
+			}
+			c.data.Tints[key] = tint
+		}
+		addPlayer(tint.Servers, server, skin.Xuid, skin.Time)
+	}
+	c.file.dirty = true
+}
+
+// PiecePopularity is how many players wear a piece on a server
+type PiecePopularity struct {
+	Server    string
+	PieceID   string
+	PieceType string
+	PackID    string
+	IsDefault bool
+	ProductID string
+	Players   int
+}
+
+// Popularity lists pieces by how many players wear them per server, most worn first.
+// server filters to one server if set, marketplaceOnly skips default pieces and ones without a ProductID.
+func (c *PersonaCatalog) Popularity(server string, marketplaceOnly bool) []PiecePopularity {
+	c.file.lock.Lock()
+	defer c.file.lock.Unlock()
+
+	var ret []PiecePopularity
+	for _, piece := range c.data.Pieces {
+		if marketplaceOnly && (piece.IsDefault || piece.ProductID == "") {
+			continue
+		}
+		for s, players := range piece.Servers {
+			if server != "" && s != server {
+				continue
+			}
+			ret = append(ret, PiecePopularity{
+				Server:    s,
+				PieceID:   piece.PieceID,
+				PieceType: piece.PieceType,
+				PackID:    piece.PackID,
+				IsDefault: piece.IsDefault,
+				ProductID: piece.ProductID,
+				Players:   len(players),
+			})
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].Players != ret[j].Players {
+			return ret[i].Players > ret[j].Players
+		}
+		return ret[i].PieceID < ret[j].PieceID
+	})
+	return ret
+}
+
+// Export writes the popularity list as json or csv
+func (c *PersonaCatalog) Export(w io.Writer, format, server string, marketplaceOnly bool) error {
+	rows := c.Popularity(server, marketplaceOnly)
+	switch format {
+	case "json":
+		e := json.NewEncoder(w)
+		e.SetIndent("", "  ")
+		return e.Encode(rows)
+	case "csv":
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"server", "piece_id", "piece_type", "pack_id", "is_default", "product_id", "players"})
+		for _, r := range rows {
+			cw.Write([]string{r.Server, r.PieceID, r.PieceType, r.PackID, strconv.FormatBool(r.IsDefault), r.ProductID, strconv.Itoa(r.Players)})
+		}
+		cw.Flush()
+		return cw.Error()
+	}
+	return fmt.Errorf("unsupported export format %s", format)
+}
+
+// TintPopularity is how many players wear a tint on a server
+type TintPopularity struct {
+	Server    string
+	PieceType string
+	Colours   []string
+	Players   int
+}
+
+// TintPopularity lists tints by how many players wear them per server, most worn first
+func (c *PersonaCatalog) TintPopularity(server string) []TintPopularity {
+	c.file.lock.Lock()
+	defer c.file.lock.Unlock()
+
+	var ret []TintPopularity
+	for _, tint := range c.data.Tints {
+		for s, players := range tint.Servers {
+			if server != "" && s != server {
+				continue
+			}
+			ret = append(ret, TintPopularity{
+				Server:    s,
+				PieceType: tint.PieceType,
+				Colours:   tint.Colours,
+				Players:   len(players),
+			})
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Players > ret[j].Players
+	})
+	return ret
+}
+
+// ExportTints writes the tint popularity list as json or csv
+func (c *PersonaCatalog) ExportTints(w io.Writer, format, server string) error {
+	rows := c.TintPopularity(server)
+	switch format {
+	case "json":
+		e := json.NewEncoder(w)
+		e.SetIndent("", "  ")
+		return e.Encode(rows)
+	case "csv":
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"server", "piece_type", "colours", "players"})
+		for _, r := range rows {
+			cw.Write([]string{r.Server, r.PieceType, strings.Join(r.Colours, " "), strconv.Itoa(r.Players)})
+		}
+		cw.Flush()
+		return cw.Error()
+	}
+	return fmt.Errorf("unsupported export format %s", format)
+}
+
+// Save writes the catalog if it changed
+func (c *PersonaCatalog) Save() error {
+	return c.file.save(&c.data)
+}
+
+// Close saves the catalog and stops saving it
+func (c *PersonaCatalog) Close() error {
+	return c.file.close(&c.data)
+}
@@ -0,0 +1,33 @@
+package utils_test
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/bedrockteam/skin-bot/utils"
+	"github.com/sandertv/gophertunnel/minecraft/protocol"
+)
+
+// players on different instances of a server count for the server
+func TestPersonaPopularityPerServer(t *testing.T) {
+	catalog, err := utils.OpenPersonaCatalog(utils.PersonaCatalogConfig{File: filepath.Join(t.TempDir(), "persona.json")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer catalog.Close()
+
+	for i, address := range []string{"play.example.com:19132 10.0.0.1", "play.example.com:19132 10.0.0.2"} {
+		skin := testSkin(i)
+		skin.ServerAddress = address
+		skin.Skin.PersonaPieces = []protocol.PersonaPiece{{PieceID: "hat", PieceType: "persona_hat", ProductID: "p1"}}
+		catalog.Record(skin)
+	}
+
+	rows := catalog.Popularity("", false)
+	if len(rows) != 1 {
+		t.Fatalf("got %d rows, wanted one for the server", len(rows))
+	}
+	if rows[0].Server != "play.example.com:19132" || rows[0].Players != 2 {
+		t.Errorf("got %s with %d players", rows[0].Server, rows[0].Players)
+	}
+}
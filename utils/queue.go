@@ -1,228 +1,790 @@
 package utils
 
 import (
-	"bytes"
-	"compress/gzip"
 	"context"
-	"encoding/json"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
-	"io"
+	"net"
+	"sync"
 	"time"
 
 	amqp "github.com/rabbitmq/amqp091-go"
 	"github.com/sirupsen/logrus"
 )
 
+// QueueConfig configures how skins are published
+type QueueConfig struct {
+	// Encoding is the body format, json or protobuf
+	Encoding string
+	// Compression is the body compression, none, gzip or zstd
+	Compression string
+	// ConfirmTimeout is how long to wait for the broker to confirm a skin before resending it
+	ConfirmTimeout time.Duration
+	// Prefetch is how many unacked skins a consumer may hold, defaults to 16
+	Prefetch int
+	// DeadLetterQueue receives skins consumers could not process, defaults to dead_skins
+	DeadLetterQueue string
+	// Topology sets up the queues and exchanges
+	Topology TopologyConfig
+	// Batch publishes several skins in one message
+	Batch BatchConfig
+	// Signing signs and encrypts skins
+	Signing SigningConfig
+	// Dial replaces connecting to a real broker, for tests
+	Dial AMQPDialer `toml:"-"`
+}
+
+// ErrQueueClosed is returned by waits on a queue that was closed
+var ErrQueueClosed = errors.New("queue closed")
+
+type mqState int
+
+const (
+	// connecting to the broker or reopening the channel
+	mqDisconnected mqState = iota
+	// conn and channel are usable
+	mqConnected
+	// Close was called
+	mqClosed
+)
+
+// mqChannel is everything belonging to one amqp channel, replaced as a whole when the channel is reopened
+type mqChannel struct {
+	channel    AMQPChannel
+	confirms   *confirmTracker
+	skin_queue amqp.Queue
+	// serializes publishes so delivery tags match GetNextPublishSeqNo
+	publish_lock sync.Mutex
+}
+
+// MQ is a connection to the message broker that reconnects by itself.
+// all state is owned by run, other goroutines only read it through current/connected.
 type MQ struct {
-	conn               *amqp.Connection
-	channel            *amqp.Channel
-	skin_queue         amqp.Queue
-	isConnected        bool
-	done               chan bool
-	inital_connect_err chan error
-	reopen             chan bool
-	notifyClose        chan *amqp.Error
+	lock    sync.Mutex
+	state   mqState
+	current *mqChannel
+	// closed and replaced every time state changes
+	changed chan struct{}
+
+	ctx     context.Context
+	cancel  context.CancelFunc
+	stopped chan struct{}
+
+	initial_once sync.Once
+	initial_err  chan error
 
 	uri         string
+	dial_func   AMQPDialer
 	want_pubsub bool
+	encoding    MessageEncoding
+
+	confirm_timeout time.Duration
+	node_id         string
+	prefetch        int
+	dead_letter     string
+	topology        TopologyConfig
+	batcher         *skinBatcher
+	signer          *messageSigner
+	metrics         *clientMetrics
+}
 
-	had_success bool
+// NewQueue starts connecting to the broker, node_id is sent along with every skin
+func NewQueue(uri string, want_pubsub bool, node_id string, config QueueConfig) (*MQ, error) {
+	return newQueue(uri, want_pubsub, node_id, config, newClientMetrics())
 }
 
-func NewQueue(uri string, want_pubsub bool) *MQ {
+func newQueue(uri string, want_pubsub bool, node_id string, config QueueConfig, metrics *clientMetrics) (*MQ, error) {
+	if err := config.Topology.setDefaults(); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
 	q := &MQ{
-		done:               make(chan bool),
-		reopen:             make(chan bool),
-		inital_connect_err: make(chan error),
-		want_pubsub:        want_pubsub,
-		uri:                uri,
+		changed:     make(chan struct{}),
+		ctx:         ctx,
+		cancel:      cancel,
+		stopped:     make(chan struct{}),
+		initial_err: make(chan error, 1),
+		want_pubsub: want_pubsub,
+		uri:         uri,
+		dial_func:   config.Dial,
+		encoding: MessageEncoding{
+			Format:      config.Encoding,
+			Compression: config.Compression,
+		}.withDefaults(),
+		confirm_timeout: config.ConfirmTimeout,
+		node_id:         node_id,
+		prefetch:        config.Prefetch,
+		dead_letter:     config.DeadLetterQueue,
+		topology:        config.Topology,
+		metrics:         metrics,
 	}
-	go q.handleReconnect()
-	return q
+	if q.confirm_timeout == 0 {
+		q.confirm_timeout = 10 * time.Second
+	}
+	if q.prefetch == 0 {
+		q.prefetch = 16
+	}
+	if q.dead_letter == "" {
+		q.dead_letter = "dead_skins"
+	}
+	signer, err := newMessageSigner(config.Signing)
+	if err != nil {
+		return nil, err
+	}
+	q.signer = signer
+	if config.Batch.Count > 1 {
+		q.batcher = newSkinBatcher(config.Batch, q.encoding.Format, q.routingKey, func(key string, skins []encodedSkin) error {
+			err := q.publishEncoded(q.ctx, key, skins)
+			if q.ctx.Err() != nil {
+				return ErrQueueClosed
+			}
+			return err
+		})
+	}
+	go q.run()
+	return q, nil
 }
 
-var reconnectDelay = 5 * time.Second
+var (
+	reconnectDelay    = 5 * time.Second
+	publishRetryDelay = 1 * time.Second
+	dialTimeout       = 30 * time.Second
+)
+
+// WaitInitial returns the result of the first connection attempt
+func (q *MQ) WaitInitial(ctx context.Context) error {
+	select {
+	case err := <-q.initial_err:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (q *MQ) reportInitial(err error) {
+	q.initial_once.Do(func() {
+		q.initial_err <- err
+	})
+}
+
+func (q *MQ) setState(state mqState, current *mqChannel) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.state == mqClosed {
+		return
+	}
+	q.state = state
+	q.current = current
+	close(q.changed)
+	q.changed = make(chan struct{})
+}
+
+// Connected reports if the queue has a channel right now
+func (q *MQ) Connected() bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return q.state == mqConnected
+}
+
+// connected waits until the queue is connected and returns the current channel
+func (q *MQ) connected(ctx context.Context) (*mqChannel, error) {
+	for {
+		q.lock.Lock()
+		state, current, changed := q.state, q.current, q.changed
+		q.lock.Unlock()
+
+		switch state {
+		case mqConnected:
+			return current, nil
+		case mqClosed:
+			return nil, ErrQueueClosed
+		}
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// sleep waits for d, returns false if the queue was closed
+func (q *MQ) sleep(d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-q.ctx.Done():
+		return false
+	}
+}
+
+// run is the state machine, it connects, reopens channels and reconnects until Close
+func (q *MQ) run() {
+	defer close(q.stopped)
+	defer func() {
+		q.lock.Lock()
+		q.state = mqClosed
+		q.current = nil
+		close(q.changed)
+		q.changed = make(chan struct{})
+		q.lock.Unlock()
+		q.reportInitial(ErrQueueClosed)
+	}()
 
-func (q *MQ) handleReconnect() {
 	for {
-		q.isConnected = false
 		logrus.Info("Attempting to connect to amqp")
-		for {
-			if err := q.connect(); err != nil {
-				logrus.Errorf("AMQP: %s", err)
-				if !q.had_success {
-					q.inital_connect_err <- err
-				}
-				logrus.Info("Failed to connect. Retrying...")
-				time.Sleep(reconnectDelay)
-				continue
+		conn, err := q.dial()
+		if err != nil {
+			if q.ctx.Err() != nil {
+				return
+			}
+			logrus.Errorf("AMQP: %s", err)
+			q.reportInitial(err)
+			logrus.Info("Failed to connect. Retrying...")
+			if !q.sleep(reconnectDelay) {
+				return
 			}
-			break
+			continue
 		}
-
 		logrus.Info("Connected to RabbitMQ")
 
-		if !q.had_success {
-			q.had_success = true
-			q.inital_connect_err <- nil
+		conn_closed := conn.NotifyClose(make(chan *amqp.Error, 1))
+		if !q.runConnection(conn, conn_closed) {
+			conn.Close()
+			return
 		}
-
-		// wait for it to close and retry
-		// or end and exit
-		select {
-		case <-q.done:
+		conn.Close()
+		if !q.sleep(reconnectDelay) {
 			return
-		case <-q.notifyClose:
 		}
 	}
 }
 
-// Reconnect connect to the message broker
-func (q *MQ) connect() error {
-	if q.conn != nil && !q.conn.IsClosed() {
-		return nil
+// runConnection keeps a channel open on conn, returns false when the queue is closed and true to reconnect
+func (q *MQ) runConnection(conn AMQPConnection, conn_closed chan *amqp.Error) bool {
+	for {
+		current, err := q.openChannel(conn)
+		if err != nil {
+			logrus.Errorf("AMQP channel: %s", err)
+			q.reportInitial(err)
+			if conn.IsClosed() {
+				return true
+			}
+			if !q.sleep(reconnectDelay) {
+				return false
+			}
+			continue
+		}
+		channel_closed := current.channel.NotifyClose(make(chan *amqp.Error, 1))
+		q.setState(mqConnected, current)
+		q.reportInitial(nil)
+
+		select {
+		case <-q.ctx.Done():
+			current.channel.Close()
+			return false
+		case err := <-conn_closed:
+			q.setState(mqDisconnected, nil)
+			logrus.Warnf("AMQP connection closed: %s", err)
+			return true
+		case err := <-channel_closed:
+			q.setState(mqDisconnected, nil)
+			if conn.IsClosed() {
+				logrus.Warnf("AMQP connection closed: %s", err)
+				return true
+			}
+			logrus.Warnf("AMQP channel closed: %s, reopening", err)
+		}
 	}
+}
 
-	conn, err := amqp.Dial(q.uri)
+// dial connects to the broker, it is aborted by Close
+func (q *MQ) dial() (AMQPConnection, error) {
+	if q.dial_func != nil {
+		return q.dial_func(q.ctx, q.uri)
+	}
+	conn, err := amqp.DialConfig(q.uri, amqp.Config{
+		Dial: func(network, addr string) (net.Conn, error) {
+			ctx, cancel := context.WithTimeout(q.ctx, dialTimeout)
+			defer cancel()
+			conn, err := (&net.Dialer{}).DialContext(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			// the deadline covers the handshake, amqp clears it afterwards
+			if err := conn.SetDeadline(time.Now().Add(dialTimeout)); err != nil {
+				conn.Close()
+				return nil, err
+			}
+			return conn, nil
+		},
+	})
 	if err != nil {
-		return err
+		return nil, err
 	}
+	return amqpConnection{conn}, nil
+}
+
+// openChannel opens a channel in confirm mode and declares the queues on it
+func (q *MQ) openChannel(conn AMQPConnection) (*mqChannel, error) {
 	ch, err := conn.Channel()
 	if err != nil {
-		return err
+		return nil, err
+	}
+	confirms, err := newConfirmTracker(ch)
+	if err != nil {
+		ch.Close()
+		return nil, err
 	}
-	ch.Confirm(false)
 
-	return q.changeConnection(conn, ch)
-}
+	if err := ch.Qos(q.prefetch, 0, false); err != nil {
+		ch.Close()
+		return nil, err
+	}
 
-func (q *MQ) changeConnection(connection *amqp.Connection, channel *amqp.Channel) error {
-	q.conn = connection
-	q.channel = channel
+	// durable so poison skins wait until someone looks at them
+	_, err = ch.QueueDeclare(q.dead_letter, true, false, false, true, nil)
+	if err != nil {
+		ch.Close()
+		return nil, err
+	}
 
-	var err error
-	q.skin_queue, err = q.channel.QueueDeclare("player_skins", false, false, false, true, nil)
+	skin_queue, err := q.topology.declare(ch, q.dead_letter)
 	if err != nil {
-		return err
+		ch.Close()
+		return nil, err
 	}
 
 	if q.want_pubsub {
-		err = q.channel.ExchangeDeclare("new_skins", "fanout", false, false, false, true, nil)
+		err = ch.ExchangeDeclare(q.topology.PubSubExchange, "fanout", false, false, false, true, nil)
 		if err != nil {
-			return err
+			ch.Close()
+			return nil, err
 		}
 	}
 
-	q.notifyClose = make(chan *amqp.Error)
-	q.conn.NotifyClose(q.notifyClose)
-	q.isConnected = true
-	close(q.reopen)
-	q.reopen = make(chan bool)
-	return nil
+	return &mqChannel{
+		channel:    ch,
+		confirms:   confirms,
+		skin_queue: skin_queue,
+	}, nil
+}
+
+// process_message verifies and decodes a message to the skins in it, batches hold more than one
+func (q *MQ) process_message(d *amqp.Delivery) ([]*QueuedSkin, error) {
+	body, err := q.signer.open(d)
+	if err != nil {
+		return nil, err
+	}
+	skins, err := DecodeSkins(d.ContentType, body)
+	if err != nil {
+		return nil, err
+	}
+	info := messageInfo(d)
+	for _, skin := range skins {
+		skin.Message = info
+	}
+	return skins, nil
 }
 
-// process_message decodes a message to skin
-func process_message(d *amqp.Delivery) (*QueuedSkin, error) {
-	body := d.Body
-	if d.ContentType == "application/json-gz" {
-		r, err := gzip.NewReader(bytes.NewBuffer(body))
+// ReceiveSkins receives skins to a channel, which is closed when ctx is done or the queue is closed.
+// skins are acked once they are read from the channel, use ConsumeSkins to ack after handling them.
+func (q *MQ) ReceiveSkins(ctx context.Context) chan *QueuedSkin {
+	ch := make(chan *QueuedSkin)
+	go func() {
+		defer close(ch)
+		q.ConsumeSkins(ctx, func(ctx context.Context, skin *QueuedSkin) error {
+			select {
+			case ch <- skin:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		})
+	}()
+	return ch
+}
+
+// ConsumeSkins calls handler for every skin on the skin queue until ctx is done or the queue is closed.
+// a skin is acked when handler returns nil, requeued when it returns an error
+// and moved to the dead letter queue when it can't be decoded or handler returns a PoisonError.
+func (q *MQ) ConsumeSkins(ctx context.Context, handler func(ctx context.Context, skin *QueuedSkin) error) error {
+	for {
+		current, err := q.connected(ctx)
 		if err != nil {
-			return nil, err
+			return err
 		}
-		body, err = io.ReadAll(r)
+		msgs, err := current.channel.Consume(q.topology.Queue, "", false, false, false, false, nil)
 		if err != nil {
-			return nil, err
+			logrus.Warn(err)
+			select {
+			case <-time.After(publishRetryDelay):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			continue
+		}
+
+	deliveries:
+		for {
+			select {
+			case d, ok := <-msgs:
+				if !ok {
+					break deliveries
+				}
+				if err := q.handleDelivery(ctx, current, &d, handler); err != nil {
+					return err
+				}
+			case <-ctx.Done():
+				return ctx.Err()
+			}
 		}
 	}
+}
 
-	var skin QueuedSkin
-	if err := json.Unmarshal(body, &skin); err != nil {
-		return nil, err
+// handleDelivery runs handler on the skins of one delivery and acks, requeues or dead letters it,
+// it only returns an error when ctx is done.
+// a batch is requeued as a whole if handler fails on any of its skins.
+func (q *MQ) handleDelivery(ctx context.Context, current *mqChannel, d *amqp.Delivery, handler func(ctx context.Context, skin *QueuedSkin) error) error {
+	skins, err := q.process_message(d)
+	if err != nil {
+		logrus.Errorf("Error processing message %s, dead lettering it", err)
+		if err := q.deadLetter(ctx, current, d, err); err != nil {
+			logrus.Warnf("Dead letter: %s", err)
+			d.Nack(false, true)
+			return nil
+		}
+		d.Ack(false)
+		return nil
+	}
+
+	for i, skin := range skins {
+		err := handler(ctx, skin)
+		if ctx.Err() != nil {
+			d.Nack(false, true)
+			return ctx.Err()
+		}
+
+		var poison *PoisonError
+		switch {
+		case err == nil:
+		case errors.As(err, &poison):
+			logrus.Errorf("Error processing skin of %s %s, dead lettering it", skin.Username, err)
+			var dead_err error
+			if len(skins) == 1 {
+				dead_err = q.deadLetter(ctx, current, d, err)
+			} else {
+				dead_err = q.deadLetterSkin(ctx, current, d, skin, err)
+			}
+			if dead_err != nil {
+				logrus.Warnf("Dead letter: %s", dead_err)
+				d.Nack(false, true)
+				return nil
+			}
+		default:
+			logrus.Warnf("Handling skin: %s, requeueing it", err)
+			if i == 0 {
+				d.Nack(false, true)
+			} else if err := q.requeueSkins(ctx, current, d, skins[i:]); err != nil {
+				// the handled skins of the batch come again
+				logrus.Warnf("Requeue: %s", err)
+				d.Nack(false, true)
+			} else {
+				d.Ack(false)
+			}
+			select {
+			case <-time.After(publishRetryDelay):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			return nil
+		}
+	}
+
+	if err := d.Ack(false); err != nil {
+		logrus.Warnf("Ack: %s", err)
+	}
+	return nil
+}
+
+// requeueSkins puts the skins of a batch that were not handled back in the queue as a new message,
+// so the batch can be acked without handling the others again
+func (q *MQ) requeueSkins(ctx context.Context, current *mqChannel, d *amqp.Delivery, skins []*QueuedSkin) error {
+	var body []byte
+	var content_type string
+	var err error
+	if len(skins) == 1 {
+		body, content_type, err = EncodeSkin(skins[0], q.encoding)
+	} else {
+		body, content_type, err = EncodeSkinBatch(skins, q.encoding)
+	}
+	if err != nil {
+		return err
 	}
 
-	return &skin, nil
+	headers := amqp.Table{}
+	for k, v := range d.Headers {
+		headers[k] = v
+	}
+	// the signature was for the whole batch
+	delete(headers, keyIdHeader)
+	delete(headers, signatureHeader)
+	delete(headers, encryptedHeader)
+	sum := sha256.Sum256(body)
+	publishing := amqp.Publishing{
+		Headers:     headers,
+		ContentType: content_type,
+		MessageId:   hex.EncodeToString(sum[:]),
+		Timestamp:   d.Timestamp,
+		AppId:       d.AppId,
+		Body:        body,
+	}
+	if err := q.signer.seal(&publishing); err != nil {
+		return err
+	}
+	return q.publishConfirmed(ctx, current, "", current.skin_queue.Name, publishing)
 }
 
-// ReceiveSkins receives skins to a channel
-func (q *MQ) ReceiveSkins() chan *QueuedSkin {
+// SubscribeSkins receives the skins published to the pubsub with PubSubSkin,
+// the channel is closed when ctx is done or the queue is closed
+func (q *MQ) SubscribeSkins(ctx context.Context) chan *QueuedSkin {
 	ch := make(chan *QueuedSkin)
 
 	go func() {
+		defer close(ch)
 		for {
-			if !q.isConnected {
-				<-q.reopen
+			current, err := q.connected(ctx)
+			if err != nil {
+				return
 			}
-			msgs, err := q.channel.Consume("player_skins", "", true, false, false, false, nil)
+			msgs, err := q.subscribe(current)
 			if err != nil {
 				logrus.Warn(err)
+				select {
+				case <-time.After(publishRetryDelay):
+				case <-ctx.Done():
+					return
+				}
 				continue
 			}
 
-			for d := range msgs {
-				skin, err := process_message(&d)
+		deliveries:
+			for {
+				var d amqp.Delivery
+				var ok bool
+				select {
+				case d, ok = <-msgs:
+					if !ok {
+						break deliveries
+					}
+				case <-ctx.Done():
+					return
+				}
+				skins, err := q.process_message(&d)
 				if err != nil {
 					logrus.Errorf("Error processing message %s", err)
 					continue
 				}
-				ch <- skin
+				for _, skin := range skins {
+					select {
+					case ch <- skin:
+					case <-ctx.Done():
+						return
+					}
+				}
 			}
 		}
 	}()
 	return ch
 }
 
-// PubSubSkin puts skin to the pubsub
-func (q *MQ) PubSubSkin(ctx context.Context, username, xuid string, data []byte) error {
-	if !q.isConnected {
-		<-q.reopen
+// subscribe binds a temporary queue to the pubsub exchange and consumes it
+func (q *MQ) subscribe(current *mqChannel) (<-chan amqp.Delivery, error) {
+	sub, err := current.channel.QueueDeclare("", false, true, true, false, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := current.channel.QueueBind(sub.Name, "", q.topology.PubSubExchange, false, nil); err != nil {
+		return nil, err
 	}
+	return current.channel.Consume(sub.Name, "", true, true, false, false, nil)
+}
 
-	err := q.channel.PublishWithContext(ctx, "new_skins", "", false, false, amqp.Publishing{
-		ContentType: "application/json",
-		Body:        data,
-	})
+// PubSubSkin publishes skin to the pubsub, retrying until the broker confirms it
+func (q *MQ) PubSubSkin(ctx context.Context, skin *QueuedSkin) error {
+	body, content_type, err := EncodeSkin(skin, q.encoding)
 	if err != nil {
-		q.conn = nil
-		return fmt.Errorf("error PubSub: %s", err)
+		return err
+	}
+	if err := q.publish(ctx, q.topology.PubSubExchange, "", q.publishing([]*QueuedSkin{skin}, body, content_type)); err != nil {
+		return fmt.Errorf("error PubSub: %w", err)
 	}
-
 	logrus.Debug("Pub/Sub skin published")
 	return nil
 }
 
-// PublishSkin publishes a skin to the skin queue
+// PublishSkin publishes a skin to the skin queue, retrying until the broker confirms it.
+// with batching it waits until the batch the skin was added to is confirmed.
+// the cape image of a skin with a CapeRef is left out.
 func (q *MQ) PublishSkin(ctx context.Context, skin *QueuedSkin) error {
-	body, _ := json.Marshal(skin)
-	buf := bytes.NewBuffer(nil)
-	w := gzip.NewWriter(buf)
-	w.Write(body)
-	w.Close()
+	skin = withoutCapeImage(skin)
+	if q.batcher != nil {
+		return q.batcher.add(ctx, skin)
+	}
+	body, content_type, err := EncodeSkin(skin, q.encoding)
+	if err != nil {
+		return err
+	}
+	return q.publish(ctx, q.topology.Exchange, q.routingKey(skin), q.publishing([]*QueuedSkin{skin}, body, content_type))
+}
 
-	for {
-		// wait for the connection
-		if !q.isConnected {
-			<-q.reopen
+// PublishSkins publishes skins in as few batches as the batch limits allow without waiting for more,
+// without batching it publishes them one by one
+func (q *MQ) PublishSkins(ctx context.Context, skins []*QueuedSkin) error {
+	if q.batcher == nil {
+		for _, skin := range skins {
+			if err := q.PublishSkin(ctx, skin); err != nil {
+				return err
+			}
 		}
+		return nil
+	}
 
-		err := q.channel.PublishWithContext(ctx, "", q.skin_queue.Name, false, false, amqp.Publishing{
-			ContentType: "application/json-gz",
-			Body:        buf.Bytes(),
-		})
+	var keys []string
+	encoded := make(map[string][]encodedSkin)
+	for _, skin := range skins {
+		skin = withoutCapeImage(skin)
+		body, err := encodeSkinBody(skin, q.encoding.Format)
 		if err != nil {
-			logrus.Warnf("Publishing: %s", err)
-			continue
+			return err
+		}
+		key := q.routingKey(skin)
+		if _, ok := encoded[key]; !ok {
+			keys = append(keys, key)
+		}
+		encoded[key] = append(encoded[key], encodedSkin{skin, body})
+	}
+
+	for _, key := range keys {
+		for _, batch := range q.batcher.split(encoded[key]) {
+			if err := q.publishEncoded(ctx, key, batch); err != nil {
+				return err
+			}
 		}
-		break
 	}
 	return nil
 }
 
-func (q *MQ) Close() {
-	q.done <- true
-	if q.channel != nil {
-		q.channel.Close()
+// routingKey is the routing key skin is published with
+func (q *MQ) routingKey(skin *QueuedSkin) string {
+	if q.topology.Exchange != "" {
+		return SkinRoutingKey(skin)
+	}
+	return q.topology.Queue
+}
+
+// encodedSkin is a skin encoded with encodeSkinBody
+type encodedSkin struct {
+	skin *QueuedSkin
+	body []byte
+}
+
+// publishEncoded publishes skins as one message, a batch if there is more than one
+func (q *MQ) publishEncoded(ctx context.Context, routing_key string, encoded []encodedSkin) error {
+	skins := make([]*QueuedSkin, 0, len(encoded))
+	bodies := make([][]byte, 0, len(encoded))
+	for _, e := range encoded {
+		skins = append(skins, e.skin)
+		bodies = append(bodies, e.body)
+	}
+
+	var body []byte
+	var content_type string
+	var err error
+	if len(bodies) == 1 {
+		enc := q.encoding.withDefaults()
+		if content_type, err = enc.ContentType(); err != nil {
+			return err
+		}
+		body, err = compress(enc.Compression, bodies[0])
+	} else {
+		body, content_type, err = encodeBatch(bodies, q.encoding)
+	}
+	if err != nil {
+		return err
+	}
+	return q.publish(ctx, q.topology.Exchange, routing_key, q.publishing(skins, body, content_type))
+}
+
+// publish sends a message to exchange, retrying until the broker confirms it
+func (q *MQ) publish(ctx context.Context, exchange, routing_key string, publishing amqp.Publishing) error {
+	if err := q.signer.seal(&publishing); err != nil {
+		return err
+	}
+	for {
+		current, err := q.connected(ctx)
+		if err != nil {
+			return err
+		}
+
+		err = q.publishConfirmed(ctx, current, exchange, routing_key, publishing)
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		logrus.Warnf("Publishing: %s, retrying", err)
+		select {
+		case <-time.After(publishRetryDelay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// publishConfirmed publishes and waits for the broker to ack it
+func (q *MQ) publishConfirmed(ctx context.Context, current *mqChannel, exchange, routing_key string, publishing amqp.Publishing) error {
+	current.publish_lock.Lock()
+	tag := current.channel.GetNextPublishSeqNo()
+	wait := current.confirms.expect(tag)
+	err := current.channel.PublishWithContext(ctx, exchange, routing_key, false, false, publishing)
+	current.publish_lock.Unlock()
+	if err != nil {
+		current.confirms.forget(tag)
+		q.metrics.publishFailures.WithLabelValues("error").Inc()
+		return err
 	}
-	if q.conn != nil {
-		q.conn.Close()
+
+	start := time.Now()
+	timeout := time.NewTimer(q.confirm_timeout)
+	defer timeout.Stop()
+	select {
+	case ack := <-wait:
+		if !ack {
+			q.metrics.publishFailures.WithLabelValues("nack").Inc()
+			return fmt.Errorf("broker nacked the skin")
+		}
+		q.metrics.publishConfirmSeconds.Observe(time.Since(start).Seconds())
+		return nil
+	case <-timeout.C:
+		current.confirms.forget(tag)
+		q.metrics.publishFailures.WithLabelValues("timeout").Inc()
+		return fmt.Errorf("no confirm after %s", q.confirm_timeout)
+	case <-ctx.Done():
+		current.confirms.forget(tag)
+		return ctx.Err()
 	}
 }
+
+// Close stops reconnecting and closes the connection, it is safe to call more than once
+func (q *MQ) Close() error {
+	q.cancel()
+	<-q.stopped
+	return nil
+}
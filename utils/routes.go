@@ -0,0 +1,338 @@
+package utils
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/sirupsen/logrus"
+)
+
+// APIConfig configures the connection to the api server
+type APIConfig struct {
+	Server string
+	Key    string
+	// RoutesRefresh is how often /routes is checked for changes, defaults to 5m
+	RoutesRefresh time.Duration
+	// RoutesCache is where the last fetched routes are saved, they are used when the api server is unreachable.
+	// defaults to routes.json
+	RoutesCache string
+	// StartRetries is how often fetching /routes is retried with backoff at startup before the cache is used,
+	// defaults to 5, -1 to not retry
+	StartRetries int
+	// StartDegraded starts even if there are no routes or the broker is unreachable,
+	// the client keeps trying in the background and the sinks buffer skins until then
+	StartDegraded bool
+	// Timeout limits every request to the api server, defaults to 1m
+	Timeout time.Duration
+	// ConnectTimeout limits connecting and the tls handshake, defaults to 10s
+	ConnectTimeout time.Duration
+	// TLS sets the CA and client certificate
+	TLS APITLSConfig
+	// SignRequests signs every request with Key and a timestamp instead of sending Key itself
+	SignRequests bool
+	// KeyId is sent with signed requests so the api server knows which Key signed them
+	KeyId string
+}
+
+type APIRoutes struct {
+	AMQPUrl           string
+	PrometheusPushURL string
+	PrometheusAuth    string
+	// UploadURL takes skin batches over http, used when there is no AMQPUrl or the broker is unreachable.
+	// relative to the api server if it starts with /
+	UploadURL string
+}
+
+// routesError is a malformed field of the routes
+type routesError struct {
+	field string
+	err   error
+}
+
+func (e *routesError) Error() string {
+	return fmt.Sprintf("routes: %s: %s", e.field, e.err)
+}
+
+// validate checks every field that is set
+func (r *APIRoutes) validate() error {
+	if r.AMQPUrl != "" {
+		if _, err := amqp.ParseURI(r.AMQPUrl); err != nil {
+			return &routesError{"AMQPUrl", err}
+		}
+	}
+	if r.PrometheusPushURL != "" {
+		if err := validateHTTPURL(r.PrometheusPushURL); err != nil {
+			return &routesError{"PrometheusPushURL", err}
+		}
+	}
+	if r.PrometheusAuth != "" && !strings.Contains(r.PrometheusAuth, ":") {
+		return &routesError{"PrometheusAuth", fmt.Errorf("not user:password")}
+	}
+	if r.UploadURL != "" && !strings.HasPrefix(r.UploadURL, "/") {
+		if err := validateHTTPURL(r.UploadURL); err != nil {
+			return &routesError{"UploadURL", err}
+		}
+	}
+	return nil
+}
+
+// validateHTTPURL checks that s is an absolute http or https url
+func validateHTTPURL(s string) error {
+	u, err := url.Parse(s)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("%q is not an http or https url", s)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("%q has no host", s)
+	}
+	return nil
+}
+
+// uploadURL is the absolute UploadURL of the current routes
+func (u *Client) uploadURL() string {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	if u.Routes == nil || u.Routes.UploadURL == "" {
+		return ""
+	}
+	if strings.HasPrefix(u.Routes.UploadURL, "/") {
+		return u.config.Server + u.Routes.UploadURL
+	}
+	return u.Routes.UploadURL
+}
+
+// routesCache is the RoutesCache file
+type routesCache struct {
+	ETag   string
+	Routes *APIRoutes
+}
+
+// fetchRoutes gets /routes, returns nil routes if they didnt change since etag
+func (u *Client) fetchRoutes(ctx context.Context, etag string) (*APIRoutes, string, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", u.config.Server+"/routes", nil)
+	if err != nil {
+		return nil, "", err
+	}
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	resp, err := u.doRequest(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotModified:
+		return nil, etag, nil
+	default:
+		return nil, "", &apiStatusError{resp.StatusCode}
+	}
+
+	routes := &APIRoutes{}
+	if err := json.NewDecoder(resp.Body).Decode(routes); err != nil {
+		return nil, "", err
+	}
+	if err := routes.validate(); err != nil {
+		return nil, "", err
+	}
+	return routes, resp.Header.Get("ETag"), nil
+}
+
+func (u *Client) loadRoutesCache() (*APIRoutes, string, error) {
+	data, err := os.ReadFile(u.config.RoutesCache)
+	if err != nil {
+		return nil, "", err
+	}
+	var cache routesCache
+	if err := json.Unmarshal(data, &cache); err != nil {
+		return nil, "", err
+	}
+	if cache.Routes == nil {
+		return nil, "", fmt.Errorf("%s has no routes", u.config.RoutesCache)
+	}
+	if err := cache.Routes.validate(); err != nil {
+		return nil, "", fmt.Errorf("%s: %s", u.config.RoutesCache, err)
+	}
+	return cache.Routes, cache.ETag, nil
+}
+
+func (u *Client) saveRoutesCache(routes *APIRoutes, etag string) {
+	data, err := json.Marshal(routesCache{ETag: etag, Routes: routes})
+	if err == nil {
+		err = writeFileAtomic(u.config.RoutesCache, data)
+	}
+	if err != nil {
+		logrus.Warnf("Saving routes: %s", err)
+	}
+}
+
+// routesRetryDelay is the first wait between route fetches that failed, it doubles every attempt
+var routesRetryDelay = 1 * time.Second
+
+// retryableRoutesError checks if fetching the routes again could work
+func retryableRoutesError(err error) bool {
+	var routes_err *routesError
+	if errors.As(err, &routes_err) {
+		return false
+	}
+	var status_err *apiStatusError
+	if errors.As(err, &status_err) {
+		status := status_err.status
+		return status/100 == 5 || status == http.StatusTooManyRequests || status == http.StatusRequestTimeout
+	}
+	return true
+}
+
+// fetchRoutesRetry fetches the routes, retrying StartRetries times with backoff while the error is not permanent
+func (u *Client) fetchRoutesRetry(ctx context.Context) (*APIRoutes, string, error) {
+	delay := routesRetryDelay
+	for attempt := 0; ; attempt++ {
+		routes, etag, err := u.fetchRoutes(ctx, "")
+		if err == nil {
+			return routes, etag, nil
+		}
+		if attempt >= u.config.StartRetries || !retryableRoutesError(err) {
+			return nil, "", err
+		}
+		logrus.Warnf("Fetching routes: %s, retrying in %s", err, delay)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, "", err
+		}
+		delay *= 2
+		if delay > 30*time.Second {
+			delay = 30 * time.Second
+		}
+	}
+}
+
+// initialRoutes fetches the routes, falling back to the cached ones
+func (u *Client) initialRoutes(ctx context.Context) (*APIRoutes, string, error) {
+	routes, etag, err := u.fetchRoutesRetry(ctx)
+	if err == nil {
+		u.saveRoutesCache(routes, etag)
+		return routes, etag, nil
+	}
+
+	cached, cached_etag, cache_err := u.loadRoutesCache()
+	if cache_err != nil {
+		return nil, "", fmt.Errorf("fetching routes: %s, no cached routes: %s", err, cache_err)
+	}
+	logrus.Warnf("Fetching routes: %s, using the cached routes", err)
+	return cached, cached_etag, nil
+}
+
+// applyRoutes connects to what changed between old and routes, old is nil at the start.
+// a new queue is connected before the old one is closed, uploads on the old one move over to it.
+func (u *Client) applyRoutes(old, routes *APIRoutes) error {
+	if old == nil || old.AMQPUrl != routes.AMQPUrl {
+		var queue *MQ
+		if routes.AMQPUrl != "" {
+			var err error
+			queue, err = newQueue(routes.AMQPUrl, u.want_pubsub, u.NodeId, u.queueConfig, u.stats)
+			if err != nil {
+				return err
+			}
+			if err := queue.WaitInitial(context.Background()); err != nil {
+				switch {
+				case routes.UploadURL != "":
+					logrus.Warnf("AMQP: %s, uploading over http instead", err)
+					queue.Close()
+					queue = nil
+				case u.config.StartDegraded:
+					// the queue keeps reconnecting, publishes wait for it
+					logrus.Warnf("AMQP: %s, starting degraded until the broker is reachable", err)
+				default:
+					queue.Close()
+					return err
+				}
+			}
+		}
+
+		u.lock.Lock()
+		old_queue := u.queue
+		u.queue = queue
+		u.lock.Unlock()
+		if old_queue != nil {
+			logrus.Info("AMQP url changed, switched to the new broker")
+			old_queue.Close()
+		}
+	}
+
+	if u.Metrics != nil && routes.PrometheusPushURL != "" {
+		if old == nil || old.PrometheusPushURL != routes.PrometheusPushURL || old.PrometheusAuth != routes.PrometheusAuth {
+			user, password, _ := strings.Cut(routes.PrometheusAuth, ":")
+			if err := u.Metrics.Start(routes.PrometheusPushURL, user, password, u.MetricCollectors()); err != nil {
+				if !u.config.StartDegraded {
+					return err
+				}
+				logrus.Warnf("Pushing metrics: %s", err)
+			}
+		}
+	}
+	return nil
+}
+
+// refreshRoutes checks /routes for changes until ctx is done.
+// while there are no routes yet it retries with backoff instead of waiting RoutesRefresh
+func (u *Client) refreshRoutes(ctx context.Context) {
+	defer close(u.refresh_done)
+	delay := routesRetryDelay
+	for {
+		u.lock.Lock()
+		current, etag := u.Routes, u.etag
+		u.lock.Unlock()
+
+		wait := u.config.RoutesRefresh
+		if current == nil {
+			wait = delay
+			delay *= 2
+			if delay > u.config.RoutesRefresh {
+				delay = u.config.RoutesRefresh
+			}
+		}
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return
+		}
+
+		routes, new_etag, err := u.fetchRoutes(ctx, etag)
+		if err != nil {
+			if ctx.Err() == nil {
+				logrus.Warnf("Refreshing routes: %s", err)
+			}
+			continue
+		}
+		if routes == nil {
+			continue
+		}
+		if current == nil || *routes != *current {
+			logrus.Info("Routes changed")
+			if err := u.applyRoutes(current, routes); err != nil {
+				// keeps the old etag so the next refresh tries again
+				logrus.Errorf("Applying new routes: %s", err)
+				continue
+			}
+		}
+
+		u.lock.Lock()
+		u.Routes, u.etag = routes, new_etag
+		u.lock.Unlock()
+		u.saveRoutesCache(routes, new_etag)
+	}
+}
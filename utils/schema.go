@@ -0,0 +1,126 @@
+package utils
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// SchemaVersion is the QueuedSkin version this build publishes
+const SchemaVersion = 2
+
+// JsonSchemas are the json schemas of every QueuedSkin version
+//
+//go:embed schema/*.json
+var JsonSchemas embed.FS
+
+// JsonSchema returns the json schema of this QueuedSkin version
+func JsonSchema(version int) ([]byte, error) {
+	return JsonSchemas.ReadFile(fmt.Sprintf("schema/queued_skin.v%d.json", version))
+}
+
+// SkinDecoder decodes an uncompressed message body of one schema version
+type SkinDecoder func(format string, body []byte) (*QueuedSkin, error)
+
+// SkinMigration upgrades a skin from the version it is registered for to the next one
+type SkinMigration func(skin *QueuedSkin) error
+
+var (
+	skinDecoders   = map[int]SkinDecoder{}
+	skinMigrations = map[int]SkinMigration{}
+)
+
+// RegisterSkinDecoder sets the decoder used for messages of this version
+func RegisterSkinDecoder(version int, decoder SkinDecoder) {
+	skinDecoders[version] = decoder
+}
+
+// RegisterSkinMigration sets the migration from version to version+1
+func RegisterSkinMigration(version int, migration SkinMigration) {
+	skinMigrations[version] = migration
+}
+
+func init() {
+	// version 0 is everything published before the version field existed, it has the same layout as 1
+	RegisterSkinDecoder(0, decodeSkinV1)
+	RegisterSkinDecoder(1, decodeSkinV1)
+	// 2 added CapeRef, which older decoders would silently drop. skins without one are still published as 1
+	RegisterSkinDecoder(2, decodeSkinV1)
+	RegisterSkinMigration(0, func(skin *QueuedSkin) error { return nil })
+	RegisterSkinMigration(1, func(skin *QueuedSkin) error { return nil })
+}
+
+func decodeSkinV1(format string, body []byte) (*QueuedSkin, error) {
+	var skin QueuedSkin
+	var err error
+	switch format {
+	case FormatJson:
+		err = json.Unmarshal(body, &skin)
+	case FormatProtobuf:
+		err = skin.UnmarshalProto(body)
+	default:
+		err = fmt.Errorf("unsupported format %s", format)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &skin, nil
+}
+
+// peekSchemaVersion reads only the version of an uncompressed body
+func peekSchemaVersion(format string, body []byte) (int, error) {
+	switch format {
+	case FormatJson:
+		var v struct{ Version int }
+		if err := json.Unmarshal(body, &v); err != nil {
+			return 0, err
+		}
+		return v.Version, nil
+	case FormatProtobuf:
+		version := 0
+		err := protoFields(body, func(num protowire.Number, typ protowire.Type, b []byte) int {
+			if num == 6 && typ == protowire.VarintType {
+				x, n := protowire.ConsumeVarint(b)
+				version = int(x)
+				return n
+			}
+			return 0
+		})
+		return version, err
+	}
+	return 0, fmt.Errorf("unsupported format %s", format)
+}
+
+// decodeVersioned picks the decoder for the version of body and migrates the result to SchemaVersion
+func decodeVersioned(format string, body []byte) (*QueuedSkin, error) {
+	version, err := peekSchemaVersion(format, body)
+	if err != nil {
+		return nil, err
+	}
+	if version > SchemaVersion {
+		return nil, fmt.Errorf("skin schema version %d is newer than supported %d", version, SchemaVersion)
+	}
+
+	decoder, ok := skinDecoders[version]
+	if !ok {
+		return nil, fmt.Errorf("no decoder for skin schema version %d", version)
+	}
+	skin, err := decoder(format, body)
+	if err != nil {
+		return nil, err
+	}
+
+	for v := version; v < SchemaVersion; v++ {
+		migration, ok := skinMigrations[v]
+		if !ok {
+			return nil, fmt.Errorf("no migration from skin schema version %d", v)
+		}
+		if err := migration(skin); err != nil {
+			return nil, fmt.Errorf("migrating skin from version %d: %s", v, err)
+		}
+	}
+	skin.Version = SchemaVersion
+	return skin, nil
+}
@@ -0,0 +1,73 @@
+package utils_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"strings"
+	"testing"
+
+	"github.com/bedrockteam/skin-bot/utils"
+)
+
+func gzipBody(t *testing.T, body []byte) []byte {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(body); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// skins published before the version field existed decode as version 0 and migrate through every version
+func TestDecodeVersion0(t *testing.T) {
+	var migrated []int
+	for v := 0; v < utils.SchemaVersion; v++ {
+		v := v
+		utils.RegisterSkinMigration(v, func(skin *utils.QueuedSkin) error {
+			migrated = append(migrated, v)
+			return nil
+		})
+	}
+	t.Cleanup(func() {
+		for v := 0; v < utils.SchemaVersion; v++ {
+			utils.RegisterSkinMigration(v, func(skin *utils.QueuedSkin) error { return nil })
+		}
+	})
+
+	v0 := testSkin(1)
+	v0.Version = 0
+	v0.Message = nil
+	v0.Skin.CapeData = "AAAA"
+	proto_body, err := v0.MarshalProto()
+	if err != nil {
+		t.Fatal(err)
+	}
+	json_body := `{"Username":"player1","Xuid":"2535400000001","ServerAddress":"play.example.com 10.0.0.1","Time":1,` +
+		`"Skin":{"SkinID":"skin1","SkinImageWidth":64,"SkinImageHeight":64,"SkinData":"AAAA","CapeData":"AAAA"}}`
+	if strings.Contains(json_body, "Version") {
+		t.Fatal("the version 0 body has a version")
+	}
+
+	for content_type, body := range map[string][]byte{
+		"application/json-gz":    gzipBody(t, []byte(json_body)),
+		"application/x-protobuf": proto_body,
+	} {
+		migrated = nil
+		skin, err := utils.DecodeSkin(content_type, body)
+		if err != nil {
+			t.Fatalf("%s: %s", content_type, err)
+		}
+		if skin.Version != utils.SchemaVersion {
+			t.Errorf("%s: decoded as version %d", content_type, skin.Version)
+		}
+		if len(migrated) != 2 || migrated[0] != 0 || migrated[1] != 1 {
+			t.Errorf("%s: migrated through %v, wanted [0 1]", content_type, migrated)
+		}
+		if skin.Username != "player1" || skin.Skin == nil || skin.Skin.SkinID != "skin1" || skin.Skin.CapeData != "AAAA" || skin.CapeRef != "" {
+			t.Errorf("%s: skin changed %+v", content_type, skin)
+		}
+	}
+}
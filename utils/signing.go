@@ -0,0 +1,220 @@
+package utils
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// SigningConfig signs and optionally encrypts published skins so consumers can reject skins
+// that didnt come from a skin-bot
+type SigningConfig struct {
+	// KeyId is the key in Keys skins are signed with, empty disables signing
+	KeyId string
+	// Keys are key id -> hex secret of at least 16 bytes.
+	// to rotate add a new key, switch KeyId to it and remove the old one once nothing signed with it is queued.
+	Keys map[string]string
+	// Encrypt encrypts the bodies with AES-256-GCM
+	Encrypt bool
+	// AllowUnsigned accepts unsigned skins even though Keys are set, for rolling out signing
+	AllowUnsigned bool
+}
+
+// headers of signed skins
+const (
+	keyIdHeader     = "x-skin-bot-key-id"
+	signatureHeader = "x-skin-bot-signature"
+	encryptedHeader = "x-skin-bot-encrypted"
+)
+
+type messageKey struct {
+	aead cipher.AEAD
+	mac  []byte
+}
+
+// messageSigner seals published skins and opens received ones
+type messageSigner struct {
+	key_id         string
+	keys           map[string]messageKey
+	encrypt        bool
+	allow_unsigned bool
+}
+
+// deriveKey derives a key for one purpose from a secret
+func deriveKey(secret []byte, purpose string) []byte {
+	h := hmac.New(sha256.New, secret)
+	h.Write([]byte(purpose))
+	return h.Sum(nil)
+}
+
+// newMessageSigner parses config, returns nil if no keys are configured
+func newMessageSigner(config SigningConfig) (*messageSigner, error) {
+	if len(config.Keys) == 0 {
+		if config.KeyId != "" || config.Encrypt {
+			return nil, fmt.Errorf("signing: no Keys configured")
+		}
+		return nil, nil
+	}
+	if config.KeyId == "" && config.Encrypt {
+		return nil, fmt.Errorf("signing: Encrypt needs a KeyId")
+	}
+	if _, ok := config.Keys[config.KeyId]; config.KeyId != "" && !ok {
+		return nil, fmt.Errorf("signing: KeyId %q is not in Keys", config.KeyId)
+	}
+
+	s := &messageSigner{
+		key_id:         config.KeyId,
+		keys:           make(map[string]messageKey),
+		encrypt:        config.Encrypt,
+		allow_unsigned: config.AllowUnsigned,
+	}
+	for id, secret_hex := range config.Keys {
+		secret, err := hex.DecodeString(secret_hex)
+		if err != nil {
+			return nil, fmt.Errorf("signing: key %s: %s", id, err)
+		}
+		if len(secret) < 16 {
+			return nil, fmt.Errorf("signing: key %s is shorter than 16 bytes", id)
+		}
+		block, err := aes.NewCipher(deriveKey(secret, "skin-bot encrypt"))
+		if err != nil {
+			return nil, err
+		}
+		gcm, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		s.keys[id] = messageKey{
+			aead: gcm,
+			mac:  deriveKey(secret, "skin-bot sign"),
+		}
+	}
+	return s, nil
+}
+
+// signedHeaders are the headers the signature covers, in the order they are hashed
+var signedHeaders = []string{
+	keyIdHeader,
+	encryptedHeader,
+	nodeIdHeader,
+	accountHeader,
+	serverHeader,
+	serverIPHeader,
+	schemaVersionHeader,
+}
+
+// headerValue formats a header the same way whichever integer type the broker hands back
+func headerValue(v any) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case int8, int16, int32, int64, int:
+		return fmt.Sprintf("%d", v)
+	}
+	return fmt.Sprint(v)
+}
+
+// signature is the hmac of the content type, message id, timestamp, signedHeaders and body, every value is length prefixed
+func (k messageKey) signature(content_type, message_id string, timestamp time.Time, headers amqp.Table, body []byte) []byte {
+	h := hmac.New(sha256.New, k.mac)
+	write := func(b []byte) {
+		var length [8]byte
+		binary.BigEndian.PutUint64(length[:], uint64(len(b)))
+		h.Write(length[:])
+		h.Write(b)
+	}
+	write([]byte(content_type))
+	write([]byte(message_id))
+	// amqp timestamps are whole seconds
+	var unix [8]byte
+	binary.BigEndian.PutUint64(unix[:], uint64(timestamp.Unix()))
+	h.Write(unix[:])
+	for _, name := range signedHeaders {
+		v, ok := headers[name]
+		if !ok {
+			h.Write([]byte{0})
+			continue
+		}
+		h.Write([]byte{1})
+		write([]byte(headerValue(v)))
+	}
+	write(body)
+	return h.Sum(nil)
+}
+
+// seal encrypts and signs a publishing with KeyId
+func (s *messageSigner) seal(p *amqp.Publishing) error {
+	if s == nil || s.key_id == "" {
+		return nil
+	}
+	key := s.keys[s.key_id]
+	if p.Headers == nil {
+		p.Headers = amqp.Table{}
+	}
+
+	if s.encrypt {
+		nonce := make([]byte, key.aead.NonceSize())
+		if _, err := rand.Read(nonce); err != nil {
+			return err
+		}
+		p.Body = key.aead.Seal(nonce, nonce, p.Body, []byte(p.ContentType))
+		p.Headers[encryptedHeader] = "aes-256-gcm"
+	}
+	// MessageId stays the hash of the plain body, the nonce is different every time the skins are sealed
+	p.Headers[keyIdHeader] = s.key_id
+	p.Headers[signatureHeader] = hex.EncodeToString(key.signature(p.ContentType, p.MessageId, p.Timestamp, p.Headers, p.Body))
+	return nil
+}
+
+// open verifies and decrypts a delivery, returns the plain body
+func (s *messageSigner) open(d *amqp.Delivery) ([]byte, error) {
+	key_id, _ := d.Headers[keyIdHeader].(string)
+	signature_hex, _ := d.Headers[signatureHeader].(string)
+	encrypted, _ := d.Headers[encryptedHeader].(string)
+
+	if s == nil {
+		if encrypted != "" {
+			return nil, fmt.Errorf("skin is encrypted but no Keys are configured")
+		}
+		return d.Body, nil
+	}
+
+	if signature_hex == "" {
+		if encrypted != "" || !s.allow_unsigned {
+			return nil, fmt.Errorf("skin is not signed")
+		}
+		return d.Body, nil
+	}
+	key, ok := s.keys[key_id]
+	if !ok {
+		return nil, fmt.Errorf("skin is signed with unknown key %q", key_id)
+	}
+	signature, err := hex.DecodeString(signature_hex)
+	if err != nil || !hmac.Equal(signature, key.signature(d.ContentType, d.MessageId, d.Timestamp, d.Headers, d.Body)) {
+		return nil, fmt.Errorf("skin has an invalid signature")
+	}
+
+	switch encrypted {
+	case "":
+		return d.Body, nil
+	case "aes-256-gcm":
+		n := key.aead.NonceSize()
+		if len(d.Body) < n {
+			return nil, fmt.Errorf("encrypted skin is too short")
+		}
+		body, err := key.aead.Open(nil, d.Body[:n], d.Body[n:], []byte(d.ContentType))
+		if err != nil {
+			return nil, fmt.Errorf("decrypting skin: %s", err)
+		}
+		return body, nil
+	}
+	return nil, fmt.Errorf("unsupported encryption %q", encrypted)
+}
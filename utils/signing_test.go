@@ -0,0 +1,90 @@
+package utils_test
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/bedrockteam/skin-bot/utils"
+	"github.com/bedrockteam/skin-bot/utils/apitest"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// a skin whose headers or properties were changed after signing is dead lettered
+func TestSignedHeaders(t *testing.T) {
+	broker := apitest.NewBroker()
+	q := openQueue(t, broker, utils.QueueConfig{Signing: utils.SigningConfig{
+		KeyId:   "k1",
+		Keys:    map[string]string{"k1": "00112233445566778899aabbccddeeff"},
+		Encrypt: true,
+	}})
+	// like a retry after the queue was swapped
+	skin := testSkin(1)
+	for i := 0; i < 2; i++ {
+		if err := q.PublishSkin(context.Background(), skin); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	published, err := broker.WaitPublished(2, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, again := published[0].Publishing, published[1].Publishing
+	if bytes.Equal(first.Body, again.Body) {
+		t.Error("the body was encrypted with the same nonce twice")
+	}
+	if first.MessageId == "" || first.MessageId != again.MessageId {
+		t.Errorf("publishing the skin again changed its MessageId from %q to %q", first.MessageId, again.MessageId)
+	}
+
+	tamper := map[string]func(p *amqp.Publishing){
+		"MessageId": func(p *amqp.Publishing) { p.MessageId = "changed" },
+		"Timestamp": func(p *amqp.Publishing) { p.Timestamp = p.Timestamp.Add(time.Hour) },
+	}
+	for _, header := range []string{"x-skin-bot-account", "x-skin-bot-server-ip", "x-skin-bot-node-id", "x-skin-bot-schema-version", "x-skin-bot-encrypted"} {
+		header := header
+		tamper[header] = func(p *amqp.Publishing) {
+			if header == "x-skin-bot-schema-version" {
+				p.Headers[header] = int32(1)
+			} else {
+				p.Headers[header] = "changed"
+			}
+		}
+	}
+	for _, f := range tamper {
+		tampered := first
+		tampered.Headers = amqp.Table{}
+		for k, v := range first.Headers {
+			tampered.Headers[k] = v
+		}
+		f(&tampered)
+		if err := broker.Publish("", "player_skins", tampered); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	got := make(chan *utils.QueuedSkin, 10)
+	go q.ConsumeSkins(ctx, func(ctx context.Context, skin *utils.QueuedSkin) error {
+		got <- skin
+		return nil
+	})
+
+	for i := 0; i < 2; i++ {
+		skin := <-got
+		if skin.Username != "player1" || skin.Message.Account != "bot1" {
+			t.Errorf("got skin of %s from %s", skin.Username, skin.Message.Account)
+		}
+	}
+	waitUntil(t, "the tampered skins are dead lettered", func() bool {
+		return broker.Len("dead_skins") == len(tamper)
+	})
+	select {
+	case skin := <-got:
+		t.Errorf("tampered skin of %s was accepted", skin.Username)
+	default:
+	}
+}
@@ -0,0 +1,262 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Sink receives the skins the bots see
+type Sink interface {
+	// Send delivers one skin
+	Send(ctx context.Context, skin *QueuedSkin) error
+	// Close flushes and closes the sink
+	Close() error
+}
+
+// batchSink is a Sink that can send several skins at once
+type batchSink interface {
+	SendBatch(ctx context.Context, skins []*QueuedSkin) error
+}
+
+// SinkConfig selects where skins are sent
+type SinkConfig struct {
+	// Types are the sinks to send to: api, amqp, http, archive, stdout.
+	// api uses amqp or the http upload, whichever the routes of the api server offer.
+	// defaults to api if API.Server is set and archive if Archive.Dir is set
+	Types []string
+	// HTTPUrl is the url the http sink posts skins to
+	HTTPUrl string
+	// HTTPAuth is the Authorization header the http sink sends, the API.Key is never sent there
+	HTTPAuth string
+	// Spool writes skins for the api and amqp sinks to disk first so they survive outages and restarts
+	Spool SpoolConfig
+	// Upload tunes the http upload of the api sink
+	Upload UploadConfig
+	// Buffer is how many skins for the api and amqp sinks are held in memory while they are sent
+	// when there is no spool, defaults to 10000
+	Buffer int
+}
+
+// OpenSinks creates the configured sinks, must be called after Start
+func (u *Client) OpenSinks(config SinkConfig, archiveConfig ArchiveConfig) error {
+	types := config.Types
+	if len(types) == 0 {
+		if u.config.Server != "" {
+			types = append(types, "api")
+		}
+		if archiveConfig.Dir != "" {
+			types = append(types, "archive")
+		}
+	}
+	if len(types) == 0 {
+		return fmt.Errorf("no sink configured, set API.Server, Archive.Dir or Sink.Types")
+	}
+
+	var sinks []Sink
+	for _, t := range types {
+		var sink Sink
+		// how long the buffer waits for more skins to send them together
+		var linger time.Duration
+		switch t {
+		case "api":
+			if u.Queue() == nil && u.uploadURL() == "" && !u.config.StartDegraded {
+				return fmt.Errorf("api sink: the API server provides neither an AMQPUrl nor an UploadURL")
+			}
+			upload := newHTTPUploader(u, config.Upload)
+			sink = &apiSink{u, upload}
+			linger = upload.config.Linger
+		case "amqp":
+			if u.Queue() == nil && !u.config.StartDegraded {
+				return fmt.Errorf("amqp sink: the API server did not provide an AMQPUrl")
+			}
+			sink = queueSink{u}
+			if u.queueConfig.Batch.Count > 1 {
+				linger = u.queueConfig.Batch.Linger
+				if linger == 0 {
+					linger = 100 * time.Millisecond
+				}
+			}
+		case "http":
+			if config.HTTPUrl == "" {
+				return fmt.Errorf("http sink: Sink.HTTPUrl undefined")
+			}
+			sink = &HTTPSink{
+				url:      config.HTTPUrl,
+				auth:     config.HTTPAuth,
+				client:   &http.Client{Timeout: u.config.Timeout},
+				encoding: MessageEncoding{u.queueConfig.Encoding, u.queueConfig.Compression},
+			}
+		case "archive":
+			if archiveConfig.Dir == "" {
+				return fmt.Errorf("archive sink: Archive.Dir undefined")
+			}
+			archive, err := OpenArchive(archiveConfig)
+			if err != nil {
+				return fmt.Errorf("archive sink: %s", err)
+			}
+			sink = archive
+		case "stdout":
+			sink = NewJsonlSink(os.Stdout)
+		default:
+			return fmt.Errorf("unknown sink %q", t)
+		}
+		if (t == "api" || t == "amqp") && config.Spool.Dir != "" {
+			spool, err := openSpool(config.Spool, u.stats)
+			if err != nil {
+				return fmt.Errorf("spool: %s", err)
+			}
+			sink = NewSpoolSink(spool, sink)
+		} else if t == "api" || t == "amqp" {
+			// the bots send skins from their packet loop, they must not wait for the upload
+			if config.Buffer == 0 {
+				config.Buffer = 10000
+			}
+			sink = newBufferSink(sink, config.Buffer, linger, func(n int) {
+				u.UploadErrors.Add(int64(n))
+			})
+		}
+		sinks = append(sinks, sink)
+	}
+
+	if len(sinks) == 1 {
+		u.Sink = sinks[0]
+	} else {
+		u.Sink = MultiSink(sinks)
+	}
+	return nil
+}
+
+// queueSink publishes to the current queue of the api client, the queue itself is closed by the api client
+type queueSink struct {
+	client *Client
+}
+
+// Send implements Sink
+func (q queueSink) Send(ctx context.Context, skin *QueuedSkin) error {
+	return q.client.WithQueue(func(mq *MQ) error {
+		return mq.PublishSkin(ctx, skin)
+	})
+}
+
+// SendBatch implements batchSink
+func (q queueSink) SendBatch(ctx context.Context, skins []*QueuedSkin) error {
+	return q.client.WithQueue(func(mq *MQ) error {
+		return mq.PublishSkins(ctx, skins)
+	})
+}
+
+// Close implements Sink
+func (q queueSink) Close() error {
+	return nil
+}
+
+// Send implements Sink
+func (a *Archive) Send(ctx context.Context, skin *QueuedSkin) error {
+	return a.Put(skin)
+}
+
+// HTTPSink posts every skin to an url, it is not the api server so it gets its own auth
+type HTTPSink struct {
+	url      string
+	auth     string
+	client   *http.Client
+	encoding MessageEncoding
+}
+
+// Send implements Sink
+func (h *HTTPSink) Send(ctx context.Context, skin *QueuedSkin) error {
+	body, content_type, err := EncodeSkin(skin, h.encoding)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", h.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", content_type)
+	if h.auth != "" {
+		req.Header.Set("Authorization", h.auth)
+	}
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("http sink: StatusCode %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Close implements Sink
+func (h *HTTPSink) Close() error {
+	return nil
+}
+
+// JsonlSink writes every skin as one line of json
+type JsonlSink struct {
+	lock sync.Mutex
+	w    io.Writer
+}
+
+// NewJsonlSink creates a sink that writes to w
+func NewJsonlSink(w io.Writer) *JsonlSink {
+	return &JsonlSink{w: w}
+}
+
+// Send implements Sink
+func (j *JsonlSink) Send(ctx context.Context, skin *QueuedSkin) error {
+	line, err := json.Marshal(skin)
+	if err != nil {
+		return err
+	}
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	_, err = j.w.Write(append(line, '\n'))
+	return err
+}
+
+// Close implements Sink
+func (j *JsonlSink) Close() error {
+	return nil
+}
+
+// MultiSink sends every skin to all of its sinks
+type MultiSink []Sink
+
+// Send implements Sink, it tries every sink even if one fails
+func (m MultiSink) Send(ctx context.Context, skin *QueuedSkin) error {
+	var errs []string
+	for _, s := range m {
+		if err := s.Send(ctx, skin); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// Close implements Sink
+func (m MultiSink) Close() error {
+	var errs []string
+	for _, s := range m {
+		if err := s.Close(); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
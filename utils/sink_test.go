@@ -0,0 +1,44 @@
+package utils_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/bedrockteam/skin-bot/utils"
+)
+
+// the http sink is a third party, it must never see the api key or a signature made with it
+func TestHTTPSinkAuth(t *testing.T) {
+	for _, sign := range []bool{false, true} {
+		var headers http.Header
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			headers = r.Header.Clone()
+			w.WriteHeader(http.StatusNoContent)
+		}))
+
+		client, err := utils.NewClient(utils.APIConfig{Key: "api-key", SignRequests: sign}, nil, utils.QueueConfig{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		config := utils.SinkConfig{Types: []string{"http"}, HTTPUrl: server.URL, HTTPAuth: "Bearer sink-token"}
+		if err := client.OpenSinks(config, utils.ArchiveConfig{}); err != nil {
+			t.Fatal(err)
+		}
+		if err := client.Sink.Send(context.Background(), testSkin(1)); err != nil {
+			t.Fatal(err)
+		}
+		server.Close()
+
+		if auth := headers.Get("Authorization"); auth != "Bearer sink-token" {
+			t.Errorf("sign %v: Authorization is %q", sign, auth)
+		}
+		for name := range headers {
+			if strings.HasPrefix(name, "X-Skin-Bot-") {
+				t.Errorf("sign %v: got signing header %s", sign, name)
+			}
+		}
+	}
+}
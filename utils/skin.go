@@ -7,11 +7,18 @@ import (
 )
 
 type QueuedSkin struct {
+	// Version is the schema version, see SchemaVersion
+	Version       int
 	Username      string
 	Xuid          string
 	Skin          *JsonSkinData
 	ServerAddress string
 	Time          int64
+	// CapeRef is the cape catalog key of the cape, queue messages dont include Skin.CapeData when its set
+	CapeRef string `json:",omitempty"`
+	// Message is sent in the message properties instead of the body.
+	// publishers set Account and IP, consumers get all of it.
+	Message *MessageInfo `json:"-"`
 }
 
 type Skin struct {
@@ -0,0 +1,368 @@
+package utils
+
+import (
+	"encoding/base64"
+	"fmt"
+	"math"
+
+	"github.com/sandertv/gophertunnel/minecraft/protocol"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// protobuf encoding of QueuedSkin, see skin.proto for the schema.
+// binary fields are sent as raw bytes instead of base64 like in the json encoding.
+
+type protoWriter struct {
+	b []byte
+}
+
+func (w *protoWriter) string(num protowire.Number, v string) {
+	if v == "" {
+		return
+	}
+	w.b = protowire.AppendTag(w.b, num, protowire.BytesType)
+	w.b = protowire.AppendString(w.b, v)
+}
+
+func (w *protoWriter) bytes(num protowire.Number, v []byte) {
+	if len(v) == 0 {
+		return
+	}
+	w.b = protowire.AppendTag(w.b, num, protowire.BytesType)
+	w.b = protowire.AppendBytes(w.b, v)
+}
+
+// base64 writes a base64 string from the json form as raw bytes
+func (w *protoWriter) base64(num protowire.Number, v string) error {
+	data, err := base64.RawStdEncoding.DecodeString(v)
+	if err != nil {
+		return fmt.Errorf("field %d: %s", num, err)
+	}
+	w.bytes(num, data)
+	return nil
+}
+
+func (w *protoWriter) varint(num protowire.Number, v uint64) {
+	if v == 0 {
+		return
+	}
+	w.b = protowire.AppendTag(w.b, num, protowire.VarintType)
+	w.b = protowire.AppendVarint(w.b, v)
+}
+
+func (w *protoWriter) bool(num protowire.Number, v bool) {
+	if v {
+		w.varint(num, 1)
+	}
+}
+
+func (w *protoWriter) float(num protowire.Number, v float32) {
+	if v == 0 {
+		return
+	}
+	w.b = protowire.AppendTag(w.b, num, protowire.Fixed32Type)
+	w.b = protowire.AppendFixed32(w.b, math.Float32bits(v))
+}
+
+func (w *protoWriter) message(num protowire.Number, v []byte) {
+	w.b = protowire.AppendTag(w.b, num, protowire.BytesType)
+	w.b = protowire.AppendBytes(w.b, v)
+}
+
+// MarshalProto encodes the skin with the protobuf schema
+func (s *QueuedSkin) MarshalProto() ([]byte, error) {
+	w := &protoWriter{}
+	w.string(1, s.Username)
+	w.string(2, s.Xuid)
+	if s.Skin != nil {
+		skin, err := s.Skin.marshalProto()
+		if err != nil {
+			return nil, err
+		}
+		w.message(3, skin)
+	}
+	w.string(4, s.ServerAddress)
+	w.varint(5, uint64(s.Time))
+	w.varint(6, uint64(s.Version))
+	w.string(7, s.CapeRef)
+	return w.b, nil
+}
+
+func (j *JsonSkinData) marshalProto() ([]byte, error) {
+	w := &protoWriter{}
+	w.string(1, j.SkinID)
+	w.string(2, j.PlayFabID)
+	if err := w.base64(3, j.SkinResourcePatch); err != nil {
+		return nil, err
+	}
+	w.varint(4, uint64(j.SkinImageWidth))
+	w.varint(5, uint64(j.SkinImageHeight))
+	if err := w.base64(6, j.SkinData); err != nil {
+		return nil, err
+	}
+	for _, a := range j.Animations {
+		aw := &protoWriter{}
+		aw.varint(1, uint64(a.ImageWidth))
+		aw.varint(2, uint64(a.ImageHeight))
+		if err := aw.base64(3, a.ImageData); err != nil {
+			return nil, err
+		}
+		aw.varint(4, uint64(a.AnimationType))
+		aw.float(5, a.FrameCount)
+		aw.varint(6, uint64(a.ExpressionType))
+		w.message(7, aw.b)
+	}
+	w.varint(8, uint64(j.CapeImageWidth))
+	w.varint(9, uint64(j.CapeImageHeight))
+	if err := w.base64(10, j.CapeData); err != nil {
+		return nil, err
+	}
+	if err := w.base64(11, j.SkinGeometry); err != nil {
+		return nil, err
+	}
+	if err := w.base64(12, j.AnimationData); err != nil {
+		return nil, err
+	}
+	w.string(13, j.GeometryDataEngineVersion)
+	w.bool(14, j.PremiumSkin)
+	w.bool(15, j.PersonaSkin)
+	w.bool(16, j.PersonaCapeOnClassicSkin)
+	w.bool(17, j.PrimaryUser)
+	w.string(18, j.CapeID)
+	w.string(19, j.FullID)
+	w.string(20, j.SkinColour)
+	w.string(21, j.ArmSize)
+	for _, p := range j.PersonaPieces {
+		pw := &protoWriter{}
+		pw.string(1, p.PieceID)
+		pw.string(2, p.PieceType)
+		pw.string(3, p.PackID)
+		pw.bool(4, p.Default)
+		pw.string(5, p.ProductID)
+		w.message(22, pw.b)
+	}
+	for _, t := range j.PieceTintColours {
+		tw := &protoWriter{}
+		tw.string(1, t.PieceType)
+		for _, c := range t.Colours {
+			tw.b = protowire.AppendTag(tw.b, 2, protowire.BytesType)
+			tw.b = protowire.AppendString(tw.b, c)
+		}
+		w.message(23, tw.b)
+	}
+	w.bool(24, j.Trusted)
+	return w.b, nil
+}
+
+// protoFields calls f for every field in b, f returns how many bytes of the value it consumed
+func protoFields(b []byte, f func(num protowire.Number, typ protowire.Type, b []byte) int) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		n = f(num, typ, b)
+		if n == 0 { // unknown field, skip it
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return fmt.Errorf("field %d: %w", num, protowire.ParseError(n))
+		}
+		b = b[n:]
+	}
+	return nil
+}
+
+func consumeString(b []byte, v *string) int {
+	s, n := protowire.ConsumeString(b)
+	*v = s
+	return n
+}
+
+func consumeBase64(b []byte, v *string) int {
+	data, n := protowire.ConsumeBytes(b)
+	*v = base64.RawStdEncoding.EncodeToString(data)
+	return n
+}
+
+func consumeUint32(b []byte, v *uint32) int {
+	x, n := protowire.ConsumeVarint(b)
+	*v = uint32(x)
+	return n
+}
+
+func consumeBool(b []byte, v *bool) int {
+	x, n := protowire.ConsumeVarint(b)
+	*v = x != 0
+	return n
+}
+
+// UnmarshalProto decodes a skin encoded with MarshalProto
+func (s *QueuedSkin) UnmarshalProto(b []byte) error {
+	var inner_err error
+	err := protoFields(b, func(num protowire.Number, typ protowire.Type, b []byte) int {
+		switch num {
+		case 1:
+			return consumeString(b, &s.Username)
+		case 2:
+			return consumeString(b, &s.Xuid)
+		case 3:
+			data, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return n
+			}
+			s.Skin = &JsonSkinData{}
+			if inner_err = s.Skin.unmarshalProto(data); inner_err != nil {
+				return -1
+			}
+			return n
+		case 4:
+			return consumeString(b, &s.ServerAddress)
+		case 5:
+			x, n := protowire.ConsumeVarint(b)
+			s.Time = int64(x)
+			return n
+		case 6:
+			x, n := protowire.ConsumeVarint(b)
+			s.Version = int(x)
+			return n
+		case 7:
+			return consumeString(b, &s.CapeRef)
+		}
+		return 0
+	})
+	if inner_err != nil {
+		return inner_err
+	}
+	return err
+}
+
+func (j *JsonSkinData) unmarshalProto(b []byte) error {
+	return protoFields(b, func(num protowire.Number, typ protowire.Type, b []byte) int {
+		switch num {
+		case 1:
+			return consumeString(b, &j.SkinID)
+		case 2:
+			return consumeString(b, &j.PlayFabID)
+		case 3:
+			return consumeBase64(b, &j.SkinResourcePatch)
+		case 4:
+			return consumeUint32(b, &j.SkinImageWidth)
+		case 5:
+			return consumeUint32(b, &j.SkinImageHeight)
+		case 6:
+			return consumeBase64(b, &j.SkinData)
+		case 7:
+			data, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return n
+			}
+			var a Skin_anim
+			err := protoFields(data, func(num protowire.Number, typ protowire.Type, b []byte) int {
+				switch num {
+				case 1:
+					return consumeUint32(b, &a.ImageWidth)
+				case 2:
+					return consumeUint32(b, &a.ImageHeight)
+				case 3:
+					return consumeBase64(b, &a.ImageData)
+				case 4:
+					return consumeUint32(b, &a.AnimationType)
+				case 5:
+					x, n := protowire.ConsumeFixed32(b)
+					a.FrameCount = math.Float32frombits(x)
+					return n
+				case 6:
+					return consumeUint32(b, &a.ExpressionType)
+				}
+				return 0
+			})
+			if err != nil {
+				return -1
+			}
+			j.Animations = append(j.Animations, a)
+			return n
+		case 8:
+			return consumeUint32(b, &j.CapeImageWidth)
+		case 9:
+			return consumeUint32(b, &j.CapeImageHeight)
+		case 10:
+			return consumeBase64(b, &j.CapeData)
+		case 11:
+			return consumeBase64(b, &j.SkinGeometry)
+		case 12:
+			return consumeBase64(b, &j.AnimationData)
+		case 13:
+			return consumeString(b, &j.GeometryDataEngineVersion)
+		case 14:
+			return consumeBool(b, &j.PremiumSkin)
+		case 15:
+			return consumeBool(b, &j.PersonaSkin)
+		case 16:
+			return consumeBool(b, &j.PersonaCapeOnClassicSkin)
+		case 17:
+			return consumeBool(b, &j.PrimaryUser)
+		case 18:
+			return consumeString(b, &j.CapeID)
+		case 19:
+			return consumeString(b, &j.FullID)
+		case 20:
+			return consumeString(b, &j.SkinColour)
+		case 21:
+			return consumeString(b, &j.ArmSize)
+		case 22:
+			data, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return n
+			}
+			var p protocol.PersonaPiece
+			err := protoFields(data, func(num protowire.Number, typ protowire.Type, b []byte) int {
+				switch num {
+				case 1:
+					return consumeString(b, &p.PieceID)
+				case 2:
+					return consumeString(b, &p.PieceType)
+				case 3:
+					return consumeString(b, &p.PackID)
+				case 4:
+					return consumeBool(b, &p.Default)
+				case 5:
+					return consumeString(b, &p.ProductID)
+				}
+				return 0
+			})
+			if err != nil {
+				return -1
+			}
+			j.PersonaPieces = append(j.PersonaPieces, p)
+			return n
+		case 23:
+			data, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return n
+			}
+			var t protocol.PersonaPieceTintColour
+			err := protoFields(data, func(num protowire.Number, typ protowire.Type, b []byte) int {
+				switch num {
+				case 1:
+					return consumeString(b, &t.PieceType)
+				case 2:
+					var c string
+					n := consumeString(b, &c)
+					t.Colours = append(t.Colours, c)
+					return n
+				}
+				return 0
+			})
+			if err != nil {
+				return -1
+			}
+			j.PieceTintColours = append(j.PieceTintColours, t)
+			return n
+		case 24:
+			return consumeBool(b, &j.Trusted)
+		}
+		return 0
+	})
+}
@@ -0,0 +1,764 @@
+package utils
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// SpoolConfig configures the disk spool skins are written to before they are published
+type SpoolConfig struct {
+	// Dir the segment files are stored in, empty disables the spool
+	Dir string
+	// SegmentSize is the size in bytes after which a new segment file is started
+	SegmentSize int64
+	// MaxSize in bytes, the oldest segments are dropped above it, 0 is unlimited
+	MaxSize int64
+	// MaxAge drops skins that couldnt be sent for this long, 0 keeps them forever
+	MaxAge time.Duration
+}
+
+// record layout: length uint32 | crc32 of payload uint32 | unix nano int64 | payload
+const spoolHeaderSize = 16
+
+// the payload is a protobuf QueuedSkin with MessageInfo.Account and IP in these extra fields
+const (
+	spoolAccountField = 100
+	spoolIPField      = 101
+)
+
+type spoolSegment struct {
+	id   uint64
+	size int64
+	// entries that are not acked yet
+	entries int
+	oldest  int64
+	newest  int64
+}
+
+// SpoolEntry is one spooled skin
+type SpoolEntry struct {
+	Skin *QueuedSkin
+	Time time.Time
+
+	segment uint64
+	next    int64
+}
+
+// Spool is a write ahead log of skins, entries stay on disk until they are acked
+type Spool struct {
+	config SpoolConfig
+
+	lock     sync.Mutex
+	segments []*spoolSegment
+	active   *os.File
+	// position of the oldest unacked entry
+	ack_segment uint64
+	ack_offset  int64
+
+	notify  chan struct{}
+	metrics *clientMetrics
+}
+
+// OpenSpool opens the spool in config.Dir, entries that were not acked are replayed
+func OpenSpool(config SpoolConfig) (*Spool, error) {
+	return openSpool(config, newClientMetrics())
+}
+
+func openSpool(config SpoolConfig, metrics *clientMetrics) (*Spool, error) {
+	if config.SegmentSize == 0 {
+		config.SegmentSize = 4 << 20
+	}
+	if err := os.MkdirAll(config.Dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	s := &Spool{
+		config:  config,
+		notify:  make(chan struct{}, 1),
+		metrics: metrics,
+	}
+	if err := s.loadSegments(true); err != nil {
+		return nil, err
+	}
+	if err := s.readAck(); err != nil {
+		return nil, err
+	}
+	// segments before the ack position were sent but not removed yet
+	for len(s.segments) > 0 && s.segments[0].id < s.ack_segment {
+		if err := os.Remove(s.segmentPath(s.segments[0].id)); err != nil {
+			return nil, err
+		}
+		s.segments = s.segments[1:]
+	}
+	if len(s.segments) > 0 && s.segments[0].id == s.ack_segment {
+		s.segments[0].entries = s.entriesAfter(s.segments[0], s.ack_offset)
+	}
+
+	var next_id uint64 = 1
+	if len(s.segments) > 0 {
+		next_id = s.segments[len(s.segments)-1].id + 1
+	}
+	if err := s.roll(next_id); err != nil {
+		return nil, err
+	}
+	if s.ack_segment == 0 || s.segment(s.ack_segment) == nil {
+		s.ack_segment, s.ack_offset = s.segments[0].id, 0
+	}
+	s.updateMetrics()
+	return s, nil
+}
+
+// InspectSpool describes the segments in config.Dir and the ack position without changing anything on disk
+func InspectSpool(config SpoolConfig) (segments []SpoolSegmentInfo, ack_segment uint64, ack_offset int64, err error) {
+	s := &Spool{config: config}
+	if err := s.loadSegments(false); err != nil {
+		return nil, 0, 0, err
+	}
+	if err := s.readAck(); err != nil {
+		return nil, 0, 0, err
+	}
+	for _, seg := range s.segments {
+		switch {
+		case seg.id < s.ack_segment:
+			seg.entries = 0
+		case seg.id == s.ack_segment:
+			seg.entries = s.entriesAfter(seg, s.ack_offset)
+		}
+	}
+	segments, ack_segment, ack_offset = s.Inspect()
+	return segments, ack_segment, ack_offset, nil
+}
+
+// loadSegments scans the segment files in the spool dir, repair truncates partly written records
+func (s *Spool) loadSegments(repair bool) error {
+	files, err := filepath.Glob(filepath.Join(s.config.Dir, "*.seg"))
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		id, err := strconv.ParseUint(strings.TrimSuffix(filepath.Base(f), ".seg"), 10, 64)
+		if err != nil {
+			continue
+		}
+		seg := &spoolSegment{id: id}
+		if err := s.scanSegment(seg, repair); err != nil {
+			return err
+		}
+		s.segments = append(s.segments, seg)
+	}
+	sort.Slice(s.segments, func(i, j int) bool {
+		return s.segments[i].id < s.segments[j].id
+	})
+	return nil
+}
+
+func (s *Spool) segmentPath(id uint64) string {
+	return filepath.Join(s.config.Dir, fmt.Sprintf("%020d.seg", id))
+}
+
+// scanSegment counts the entries of a segment, with repair it truncates a partly written last record
+func (s *Spool) scanSegment(seg *spoolSegment, repair bool) error {
+	flag := os.O_RDONLY
+	if repair {
+		flag = os.O_RDWR
+	}
+	f, err := os.OpenFile(s.segmentPath(seg.id), flag, 0o644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var offset int64
+	for {
+		t, payload, err := readSpoolRecord(f, offset)
+		if err != nil {
+			if err != io.EOF && repair {
+				logrus.Warnf("Spool: segment %d is corrupt at %d, truncating: %s", seg.id, offset, err)
+				if err := f.Truncate(offset); err != nil {
+					return err
+				}
+			}
+			break
+		}
+		if seg.oldest == 0 {
+			seg.oldest = t
+		}
+		seg.newest = t
+		seg.entries++
+		offset += spoolHeaderSize + int64(len(payload))
+	}
+	seg.size = offset
+	return nil
+}
+
+// readSpoolRecord reads the record at offset, io.EOF if there is none.
+// on a checksum mismatch the payload is returned with the error so the record can be skipped
+func readSpoolRecord(f *os.File, offset int64) (t int64, payload []byte, err error) {
+	header := make([]byte, spoolHeaderSize)
+	n, err := f.ReadAt(header, offset)
+	if n == 0 && err == io.EOF {
+		return 0, nil, io.EOF
+	}
+	if n < spoolHeaderSize {
+		return 0, nil, fmt.Errorf("short header")
+	}
+	length := binary.LittleEndian.Uint32(header[0:4])
+	sum := binary.LittleEndian.Uint32(header[4:8])
+	t = int64(binary.LittleEndian.Uint64(header[8:16]))
+
+	payload = make([]byte, length)
+	if _, err := f.ReadAt(payload, offset+spoolHeaderSize); err != nil {
+		return 0, nil, fmt.Errorf("short payload")
+	}
+	if crc32.ChecksumIEEE(payload) != sum {
+		return 0, payload, fmt.Errorf("checksum mismatch")
+	}
+	return t, payload, nil
+}
+
+func (s *Spool) readAck() error {
+	data, err := os.ReadFile(filepath.Join(s.config.Dir, "ack"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	_, err = fmt.Sscanf(string(data), "%d %d", &s.ack_segment, &s.ack_offset)
+	return err
+}
+
+func (s *Spool) writeAck() error {
+	return writeFileAtomic(filepath.Join(s.config.Dir, "ack"), []byte(fmt.Sprintf("%d %d", s.ack_segment, s.ack_offset)))
+}
+
+func (s *Spool) segment(id uint64) *spoolSegment {
+	for _, seg := range s.segments {
+		if seg.id == id {
+			return seg
+		}
+	}
+	return nil
+}
+
+// roll starts a new active segment
+func (s *Spool) roll(id uint64) error {
+	f, err := os.OpenFile(s.segmentPath(id), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	if s.active != nil {
+		s.active.Close()
+	}
+	s.active = f
+	s.segments = append(s.segments, &spoolSegment{id: id})
+	return nil
+}
+
+// Append writes the skin to the active segment and syncs it to disk
+func (s *Spool) Append(skin *QueuedSkin) error {
+	payload, err := skin.MarshalProto()
+	if err != nil {
+		return err
+	}
+	if skin.Message != nil {
+		// not part of the skin message, skin decoders skip these fields
+		w := &protoWriter{b: payload}
+		w.string(spoolAccountField, skin.Message.Account)
+		w.string(spoolIPField, skin.Message.IP)
+		payload = w.b
+	}
+	now := time.Now().UnixNano()
+	record := make([]byte, spoolHeaderSize+len(payload))
+	binary.LittleEndian.PutUint32(record[0:4], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(payload))
+	binary.LittleEndian.PutUint64(record[8:16], uint64(now))
+	copy(record[spoolHeaderSize:], payload)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	seg := s.segments[len(s.segments)-1]
+	if seg.size > 0 && seg.size+int64(len(record)) > s.config.SegmentSize {
+		if err := s.roll(seg.id + 1); err != nil {
+			return err
+		}
+		seg = s.segments[len(s.segments)-1]
+	}
+
+	if _, err := s.active.Write(record); err != nil {
+		return err
+	}
+	if err := s.active.Sync(); err != nil {
+		return err
+	}
+	seg.size += int64(len(record))
+	seg.entries++
+	if seg.oldest == 0 {
+		seg.oldest = now
+	}
+	seg.newest = now
+
+	s.enforceMaxSize()
+	s.expireSegments()
+	s.updateMetrics()
+
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// enforceMaxSize drops the oldest segments while the spool is too big
+func (s *Spool) enforceMaxSize() {
+	if s.config.MaxSize <= 0 {
+		return
+	}
+	for len(s.segments) > 1 && s.totalSize() > s.config.MaxSize {
+		seg := s.segments[0]
+		dropped := seg.entries
+		logrus.Warnf("Spool: over MaxSize, dropping segment %d with %d skins", seg.id, dropped)
+		s.metrics.spoolDropped.WithLabelValues("size").Add(float64(dropped))
+		s.removeFirstSegment()
+	}
+}
+
+// expireSegments drops the oldest segments while all of their skins are older than MaxAge, must hold lock
+func (s *Spool) expireSegments() {
+	if s.config.MaxAge <= 0 {
+		return
+	}
+	for len(s.segments) > 1 && time.Since(time.Unix(0, s.segments[0].newest)) > s.config.MaxAge {
+		seg := s.segments[0]
+		if seg.entries > 0 {
+			logrus.Warnf("Spool: segment %d is older than MaxAge, dropping %d skins", seg.id, seg.entries)
+			s.metrics.spoolDropped.WithLabelValues("age").Add(float64(seg.entries))
+		}
+		s.removeFirstSegment()
+	}
+}
+
+// expire drops the segments that are older than MaxAge
+func (s *Spool) expire() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.expireSegments()
+	s.updateMetrics()
+}
+
+// contains checks that the segment of entry wasnt dropped
+func (s *Spool) contains(entry *SpoolEntry) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.segment(entry.segment) != nil
+}
+
+// entriesAfter counts the entries of seg at or after offset
+func (s *Spool) entriesAfter(seg *spoolSegment, offset int64) int {
+	f, err := os.Open(s.segmentPath(seg.id))
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+	count := 0
+	for {
+		_, payload, err := readSpoolRecord(f, offset)
+		if err != nil {
+			return count
+		}
+		count++
+		offset += spoolHeaderSize + int64(len(payload))
+	}
+}
+
+// removeFirstSegment deletes the oldest segment and moves the ack position past it if needed
+func (s *Spool) removeFirstSegment() {
+	seg := s.segments[0]
+	if err := os.Remove(s.segmentPath(seg.id)); err != nil {
+		logrus.Warnf("Spool: %s", err)
+	}
+	s.segments = s.segments[1:]
+	if s.ack_segment <= seg.id {
+		s.ack_segment, s.ack_offset = s.segments[0].id, 0
+		s.writeAck()
+	}
+}
+
+func (s *Spool) totalSize() (size int64) {
+	for _, seg := range s.segments {
+		size += seg.size
+	}
+	return size
+}
+
+// Next blocks until there is an unacked entry and returns it
+func (s *Spool) Next(ctx context.Context) (*SpoolEntry, error) {
+	for {
+		entry, err := s.next()
+		if err != nil {
+			return nil, err
+		}
+		if entry != nil {
+			return entry, nil
+		}
+		select {
+		case <-s.notify:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (s *Spool) next() (*SpoolEntry, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for {
+		seg := s.segment(s.ack_segment)
+		if seg == nil {
+			// removed by hand, continue with the segment after it
+			next := s.segments[len(s.segments)-1]
+			for _, seg := range s.segments {
+				if seg.id > s.ack_segment {
+					next = seg
+					break
+				}
+			}
+			logrus.Warnf("Spool: acked segment %d is missing, continuing at segment %d", s.ack_segment, next.id)
+			s.ack_segment, s.ack_offset = next.id, 0
+			s.writeAck()
+			continue
+		}
+		if s.ack_offset < seg.size {
+			return s.readEntry(seg, s.ack_offset)
+		}
+
+		// everything in this segment is acked
+		if seg == s.segments[len(s.segments)-1] {
+			return nil, nil
+		}
+		s.removeFirstSegment()
+		s.updateMetrics()
+	}
+}
+
+// peek returns the entry after entry if it is in the same segment, without blocking.
+// entries are acked in order so a batch never spans segments.
+func (s *Spool) peek(entry *SpoolEntry) (*SpoolEntry, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	seg := s.segment(entry.segment)
+	if seg == nil || entry.next >= seg.size {
+		return nil, nil
+	}
+	return s.readEntry(seg, entry.next)
+}
+
+// spoolCorruptError is an entry that can't be read back, replaying skips to next
+type spoolCorruptError struct {
+	segment uint64
+	offset  int64
+	next    int64
+	err     error
+}
+
+func (e *spoolCorruptError) Error() string {
+	return fmt.Sprintf("spool: segment %d at %d: %s", e.segment, e.offset, e.err)
+}
+
+// readEntry reads the entry at offset of seg, must hold lock
+func (s *Spool) readEntry(seg *spoolSegment, offset int64) (*SpoolEntry, error) {
+	f, err := os.Open(s.segmentPath(seg.id))
+	if err != nil {
+		return nil, err
+	}
+	t, payload, err := readSpoolRecord(f, offset)
+	f.Close()
+	next := offset + spoolHeaderSize + int64(len(payload))
+	if err != nil {
+		if payload == nil || next > seg.size {
+			// the length cant be trusted, the rest of the segment is lost
+			next = seg.size
+		}
+		return nil, &spoolCorruptError{seg.id, offset, next, err}
+	}
+	skin, err := decodeVersioned(FormatProtobuf, payload)
+	if err != nil {
+		return nil, &spoolCorruptError{seg.id, offset, next, err}
+	}
+	info := &MessageInfo{}
+	err = protoFields(payload, func(num protowire.Number, typ protowire.Type, b []byte) int {
+		switch num {
+		case spoolAccountField:
+			return consumeString(b, &info.Account)
+		case spoolIPField:
+			return consumeString(b, &info.IP)
+		}
+		return 0
+	})
+	if err != nil {
+		return nil, &spoolCorruptError{seg.id, offset, next, err}
+	}
+	skin.Message = info
+	return &SpoolEntry{
+		Skin:    skin,
+		Time:    time.Unix(0, t),
+		segment: seg.id,
+		next:    next,
+	}, nil
+}
+
+// skip moves the ack position past the entry that could not be read
+func (s *Spool) skip(bad *spoolCorruptError) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if bad.segment != s.ack_segment || bad.offset != s.ack_offset {
+		return nil
+	}
+	s.ack_offset = bad.next
+	if seg := s.segment(bad.segment); seg != nil {
+		seg.entries = s.entriesAfter(seg, s.ack_offset)
+	}
+	s.updateMetrics()
+	return s.writeAck()
+}
+
+// Ack marks the entries and everything before them as sent, entries must be in order
+func (s *Spool) Ack(entries ...*SpoolEntry) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, entry := range entries {
+		if entry.segment != s.ack_segment {
+			// its segment was dropped in the meantime
+			continue
+		}
+		s.ack_offset = entry.next
+		if seg := s.segment(entry.segment); seg != nil {
+			seg.entries--
+		}
+	}
+	s.updateMetrics()
+	return s.writeAck()
+}
+
+func (s *Spool) updateMetrics() {
+	pending := 0
+	for _, seg := range s.segments {
+		pending += seg.entries
+	}
+	s.metrics.spoolEntries.Set(float64(pending))
+	s.metrics.spoolBytes.Set(float64(s.totalSize()))
+}
+
+// SpoolSegmentInfo describes one segment file
+type SpoolSegmentInfo struct {
+	ID      uint64
+	Size    int64
+	Pending int
+	Oldest  time.Time
+	Newest  time.Time
+	Acked   bool
+}
+
+// Inspect describes all segments and the ack position
+func (s *Spool) Inspect() (segments []SpoolSegmentInfo, ack_segment uint64, ack_offset int64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, seg := range s.segments {
+		segments = append(segments, SpoolSegmentInfo{
+			ID:      seg.id,
+			Size:    seg.size,
+			Pending: seg.entries,
+			Oldest:  time.Unix(0, seg.oldest),
+			Newest:  time.Unix(0, seg.newest),
+			Acked:   seg.id < s.ack_segment || (seg.id == s.ack_segment && s.ack_offset >= seg.size),
+		})
+	}
+	return segments, s.ack_segment, s.ack_offset
+}
+
+// Close closes the active segment
+func (s *Spool) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.active.Close()
+}
+
+// SpoolSink spools every skin to disk and sends it to the inner sink in the background
+type SpoolSink struct {
+	spool *Spool
+	inner Sink
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// NewSpoolSink starts replaying the spool to inner
+func NewSpoolSink(spool *Spool, inner Sink) *SpoolSink {
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &SpoolSink{
+		spool:  spool,
+		inner:  inner,
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	go s.replay(ctx)
+	return s
+}
+
+// spoolReplayBatch is the most entries replayed at once to a sink that takes batches
+const spoolReplayBatch = 256
+
+func (s *SpoolSink) replay(ctx context.Context) {
+	defer close(s.done)
+	// after a batch was rejected its entries are sent one at a time to find the rejected ones
+	single := 0
+	for {
+		entry, err := s.spool.Next(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			var corrupt *spoolCorruptError
+			if errors.As(err, &corrupt) {
+				logrus.Errorf("%s, skipping it", err)
+				s.spool.metrics.spoolDropped.WithLabelValues("corrupt").Inc()
+				if err := s.spool.skip(corrupt); err != nil {
+					logrus.Warnf("Spool: ack: %s", err)
+				}
+				continue
+			}
+			logrus.Errorf("Spool: %s", err)
+			select {
+			case <-time.After(publishRetryDelay):
+			case <-ctx.Done():
+				return
+			}
+			continue
+		}
+		entries := []*SpoolEntry{entry}
+		if single > 0 {
+			single--
+		} else {
+			entries = s.readBatch(entry)
+		}
+
+		err = s.deliver(ctx, entries)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			if len(entries) > 1 {
+				logrus.Warnf("Spool: %s, sending the %d skins of the batch one at a time", err, len(entries))
+				single = len(entries)
+				continue
+			}
+			logrus.Warnf("Spool: %s, dropping the skin of %s", err, entry.Skin.Username)
+			s.spool.metrics.spoolDropped.WithLabelValues("rejected").Inc()
+		}
+
+		if err := s.spool.Ack(entries...); err != nil {
+			logrus.Warnf("Spool: ack: %s", err)
+		}
+	}
+}
+
+// deliver sends entries, retrying until they are sent, older than MaxAge or rejected for good, it returns the rejection
+func (s *SpoolSink) deliver(ctx context.Context, entries []*SpoolEntry) error {
+	for {
+		entries = s.unexpired(entries)
+		if len(entries) == 0 {
+			return nil
+		}
+		skins := make([]*QueuedSkin, 0, len(entries))
+		for _, entry := range entries {
+			skins = append(skins, entry.Skin)
+		}
+		err := s.send(ctx, skins)
+		var rejected *uploadError
+		if err == nil || ctx.Err() != nil || errors.As(err, &rejected) {
+			return err
+		}
+		logrus.Warnf("Spool: %s", err)
+		select {
+		case <-time.After(publishRetryDelay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		// the skins behind these keep getting older while the sink is down
+		s.spool.expire()
+	}
+}
+
+// unexpired drops the entries older than MaxAge
+func (s *SpoolSink) unexpired(entries []*SpoolEntry) []*SpoolEntry {
+	var ret []*SpoolEntry
+	for _, entry := range entries {
+		if !s.spool.contains(entry) {
+			// dropped and counted with its segment
+			continue
+		}
+		if s.spool.config.MaxAge > 0 && time.Since(entry.Time) > s.spool.config.MaxAge {
+			s.spool.metrics.spoolDropped.WithLabelValues("age").Inc()
+			continue
+		}
+		ret = append(ret, entry)
+	}
+	return ret
+}
+
+// readBatch reads the entries following first that can be sent together with it,
+// it stops before an entry that can't be read, Next returns that one again
+func (s *SpoolSink) readBatch(first *SpoolEntry) []*SpoolEntry {
+	entries := []*SpoolEntry{first}
+	if _, ok := s.inner.(batchSink); !ok {
+		return entries
+	}
+	for len(entries) < spoolReplayBatch {
+		entry, err := s.spool.peek(entries[len(entries)-1])
+		if err != nil || entry == nil {
+			break
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func (s *SpoolSink) send(ctx context.Context, skins []*QueuedSkin) error {
+	if batch, ok := s.inner.(batchSink); ok {
+		return batch.SendBatch(ctx, skins)
+	}
+	return s.inner.Send(ctx, skins[0])
+}
+
+// Send implements Sink, it returns once the skin is on disk
+func (s *SpoolSink) Send(ctx context.Context, skin *QueuedSkin) error {
+	return s.spool.Append(skin)
+}
+
+// Close stops replaying, unsent skins stay in the spool
+func (s *SpoolSink) Close() error {
+	s.cancel()
+	<-s.done
+	if err := s.inner.Close(); err != nil {
+		s.spool.Close()
+		return err
+	}
+	return s.spool.Close()
+}
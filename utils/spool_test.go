@@ -0,0 +1,247 @@
+package utils_test
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bedrockteam/skin-bot/utils"
+	"github.com/bedrockteam/skin-bot/utils/apitest"
+)
+
+// collectSink keeps the skins sent to it
+type collectSink struct {
+	lock  sync.Mutex
+	skins []*utils.QueuedSkin
+}
+
+func (c *collectSink) Send(ctx context.Context, skin *utils.QueuedSkin) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.skins = append(c.skins, skin)
+	return nil
+}
+
+func (c *collectSink) Close() error {
+	return nil
+}
+
+func (c *collectSink) wait(t *testing.T, n int) []*utils.QueuedSkin {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		c.lock.Lock()
+		skins := append([]*utils.QueuedSkin(nil), c.skins...)
+		c.lock.Unlock()
+		if len(skins) >= n {
+			return skins
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("sink did not get %d skins", n)
+	return nil
+}
+
+// appendRecord writes a record with a valid checksum around payload to a segment file
+func appendRecord(t *testing.T, path string, payload []byte) {
+	record := make([]byte, 16+len(payload))
+	binary.LittleEndian.PutUint32(record[0:4], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(payload))
+	binary.LittleEndian.PutUint64(record[8:16], uint64(time.Now().UnixNano()))
+	copy(record[16:], payload)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.Write(record); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// an entry that cant be decoded is skipped, the ones after it are still sent
+func TestSpoolSkipsBadEntries(t *testing.T) {
+	config := utils.SpoolConfig{Dir: t.TempDir()}
+	spool, err := utils.OpenSpool(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := spool.Append(testSkin(0)); err != nil {
+		t.Fatal(err)
+	}
+	spool.Close()
+	appendRecord(t, filepath.Join(config.Dir, "00000000000000000001.seg"), []byte{0xff, 0xff, 0xff})
+
+	spool, err = utils.OpenSpool(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := spool.Append(testSkin(2)); err != nil {
+		t.Fatal(err)
+	}
+	sink := &collectSink{}
+	spool_sink := utils.NewSpoolSink(spool, sink)
+	defer spool_sink.Close()
+
+	skins := sink.wait(t, 2)
+	if len(skins) != 2 || skins[0].Username != "player0" || skins[1].Username != "player2" {
+		t.Errorf("sink got %d skins", len(skins))
+	}
+}
+
+// inspecting a spool must not create or remove anything
+func TestInspectSpoolReadOnly(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "spool")
+	if _, _, _, err := utils.InspectSpool(utils.SpoolConfig{Dir: dir}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("InspectSpool created %s", dir)
+	}
+
+	spool, err := utils.OpenSpool(utils.SpoolConfig{Dir: dir, SegmentSize: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := spool.Append(testSkin(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	spool.Close()
+	before, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	segments, _, _, err := utils.InspectSpool(utils.SpoolConfig{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pending := 0
+	for _, seg := range segments {
+		pending += seg.Pending
+	}
+	if pending != 3 {
+		t.Errorf("InspectSpool found %d pending skins, wanted 3", pending)
+	}
+	after, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(after) != len(before) {
+		t.Errorf("InspectSpool changed the spool dir from %d to %d files", len(before), len(after))
+	}
+}
+
+// a skin the api server rejects is dropped, the skins batched with it and after it are still sent
+func TestSpoolDropsRejected(t *testing.T) {
+	server := apitest.NewServer("key")
+	t.Cleanup(server.Close)
+	server.RejectSkinsOf("player2")
+	config := utils.SpoolConfig{Dir: t.TempDir()}
+	client, err := utils.NewClient(server.Config(), nil, utils.QueueConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Start(false); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(client.Close)
+
+	// spool them before the sink replays so they are sent as one batch
+	spool, err := utils.OpenSpool(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 5; i++ {
+		if err := spool.Append(testSkin(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	spool.Close()
+	if err := client.OpenSinks(utils.SinkConfig{Spool: config}, utils.ArchiveConfig{}); err != nil {
+		t.Fatal(err)
+	}
+
+	skins, err := server.WaitSkins(4, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, skin := range skins {
+		if skin.Username == "player2" {
+			t.Error("rejected skin was recorded")
+		}
+	}
+	client.UploadSkin(context.Background(), &utils.Skin{}, "player6", "2535400000006", "play.example.com", "bot1", "10.0.0.1")
+	if _, err := server.WaitSkins(5, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// failSink is a sink that is down
+type failSink struct{}
+
+func (failSink) Send(ctx context.Context, skin *utils.QueuedSkin) error {
+	return errors.New("sink is down")
+}
+
+func (failSink) Close() error {
+	return nil
+}
+
+func spoolPending(spool *utils.Spool) int {
+	segments, _, _ := spool.Inspect()
+	pending := 0
+	for _, seg := range segments {
+		pending += seg.Pending
+	}
+	return pending
+}
+
+// skins older than MaxAge are dropped while the sink is down, the one being retried too
+func TestSpoolMaxAgeWhileDown(t *testing.T) {
+	config := utils.SpoolConfig{Dir: t.TempDir(), MaxAge: 100 * time.Millisecond}
+	spool, err := utils.OpenSpool(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spool_sink := utils.NewSpoolSink(spool, failSink{})
+	defer spool_sink.Close()
+	for i := 0; i < 3; i++ {
+		if err := spool.Append(testSkin(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitUntil(t, "the spool is empty", func() bool {
+		return spoolPending(spool) == 0
+	})
+}
+
+// whole segments older than MaxAge are dropped even when nothing replays them
+func TestSpoolExpiresSegments(t *testing.T) {
+	config := utils.SpoolConfig{Dir: t.TempDir(), SegmentSize: 1, MaxAge: 100 * time.Millisecond}
+	spool, err := utils.OpenSpool(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer spool.Close()
+	for i := 0; i < 2; i++ {
+		if err := spool.Append(testSkin(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(150 * time.Millisecond)
+	if err := spool.Append(testSkin(2)); err != nil {
+		t.Fatal(err)
+	}
+	segments, _, _ := spool.Inspect()
+	if len(segments) != 1 || spoolPending(spool) != 1 {
+		t.Errorf("%d segments with %d skins are left, wanted the newest one", len(segments), spoolPending(spool))
+	}
+}
@@ -0,0 +1,131 @@
+package utils
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// TopologyConfig sets up the queues and exchanges skins go through
+type TopologyConfig struct {
+	// Queue is the queue consumers read skins from, defaults to player_skins
+	Queue string
+	// QueueType is classic or quorum, quorum queues are always durable
+	QueueType string
+	// Durable keeps Queue and Exchange across broker restarts
+	Durable bool
+	// MessageTTL drops skins that were not consumed in time, 0 keeps them
+	MessageTTL time.Duration
+	// MaxLength drops the oldest skins when Queue is longer, 0 is unlimited
+	MaxLength int
+	// DeadLetterExchange makes the broker move skins dropped by MessageTTL or MaxLength to the dead letter queue.
+	// the broker refuses to change the arguments of an existing Queue, it has to be deleted first.
+	DeadLetterExchange bool
+	// Exchange is a topic exchange skins are published to with the routing key
+	// <server>.<classification>, empty publishes straight to Queue
+	Exchange string
+	// BindingKeys bind Queue to Exchange, defaults to #
+	BindingKeys []string
+	// PubSubExchange is the fanout exchange for new skins, defaults to new_skins
+	PubSubExchange string
+}
+
+func (t *TopologyConfig) setDefaults() error {
+	if t.Queue == "" {
+		t.Queue = "player_skins"
+	}
+	if t.PubSubExchange == "" {
+		t.PubSubExchange = "new_skins"
+	}
+	switch t.QueueType {
+	case "", "classic":
+	case "quorum":
+		t.Durable = true
+	default:
+		return fmt.Errorf("unknown queue type %q", t.QueueType)
+	}
+	if len(t.BindingKeys) == 0 {
+		t.BindingKeys = []string{"#"}
+	}
+	return nil
+}
+
+// queueArgs are the x- arguments Queue is declared with
+func (t *TopologyConfig) queueArgs(dead_letter string) amqp.Table {
+	args := amqp.Table{}
+	// classic is left out so existing queues declared without arguments still match
+	if t.QueueType == "quorum" {
+		args["x-queue-type"] = t.QueueType
+	}
+	if t.MessageTTL > 0 {
+		args["x-message-ttl"] = t.MessageTTL.Milliseconds()
+	}
+	if t.MaxLength > 0 {
+		args["x-max-length"] = int64(t.MaxLength)
+	}
+	if t.DeadLetterExchange {
+		// through the default exchange, it routes by queue name
+		args["x-dead-letter-exchange"] = ""
+		args["x-dead-letter-routing-key"] = dead_letter
+	}
+	return args
+}
+
+// declare declares Queue and Exchange on ch and binds them, dead_letter is the dead letter queue
+func (t *TopologyConfig) declare(ch AMQPChannel, dead_letter string) (amqp.Queue, error) {
+	queue, err := ch.QueueDeclare(t.Queue, t.Durable, false, false, false, t.queueArgs(dead_letter))
+	if err != nil {
+		return queue, err
+	}
+	if t.Exchange == "" {
+		return queue, nil
+	}
+
+	if err := ch.ExchangeDeclare(t.Exchange, "topic", t.Durable, false, false, false, nil); err != nil {
+		return queue, err
+	}
+	for _, key := range t.BindingKeys {
+		if err := ch.QueueBind(t.Queue, key, t.Exchange, false, nil); err != nil {
+			return queue, err
+		}
+	}
+	return queue, nil
+}
+
+// SkinClassification sorts skins into persona, premium or custom
+func SkinClassification(skin *JsonSkinData) string {
+	switch {
+	case skin == nil:
+		return "unknown"
+	case skin.PersonaSkin:
+		return "persona"
+	case skin.PremiumSkin:
+		return "premium"
+	}
+	return "custom"
+}
+
+// routingKeyWord makes s usable as one word of a topic routing key
+func routingKeyWord(s string) string {
+	s = strings.ToLower(s)
+	s = strings.NewReplacer(".", "_", "*", "_", "#", "_", " ", "_").Replace(s)
+	if s == "" {
+		return "unknown"
+	}
+	return s
+}
+
+// SkinRoutingKey is the routing key a skin is published to Exchange with,
+// <server>.<classification> with the port and instance ip dropped from the server
+func SkinRoutingKey(skin *QueuedSkin) string {
+	server := skin.ServerAddress
+	if i := strings.IndexByte(server, ' '); i >= 0 {
+		server = server[:i]
+	}
+	if i := strings.LastIndexByte(server, ':'); i >= 0 {
+		server = server[:i]
+	}
+	return routingKeyWord(server) + "." + SkinClassification(skin.Skin)
+}
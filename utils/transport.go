@@ -0,0 +1,161 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// APITLSConfig configures tls to the api server
+type APITLSConfig struct {
+	// CAFile is a pem file with the CAs to check the api server certificate against instead of the system ones
+	CAFile string
+	// CertFile and KeyFile are the pem client certificate and its key
+	CertFile string
+	KeyFile  string
+}
+
+// headers of signed requests
+const (
+	headerRequestKeyId     = "X-Skin-Bot-Key-Id"
+	headerRequestTimestamp = "X-Skin-Bot-Timestamp"
+	headerRequestNonce     = "X-Skin-Bot-Nonce"
+	headerRequestSignature = "X-Skin-Bot-Signature"
+)
+
+// newHTTPClient creates the http client for the api server with the timeouts and tls of config
+func newHTTPClient(config APIConfig) (*http.Client, error) {
+	tls_config, err := config.TLS.load()
+	if err != nil {
+		return nil, err
+	}
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   config.ConnectTimeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSClientConfig:       tls_config,
+		TLSHandshakeTimeout:   config.ConnectTimeout,
+		ResponseHeaderTimeout: config.Timeout,
+		IdleConnTimeout:       90 * time.Second,
+		MaxIdleConnsPerHost:   4,
+		ForceAttemptHTTP2:     true,
+	}
+	return &http.Client{
+		Transport: transport,
+		Timeout:   config.Timeout,
+	}, nil
+}
+
+// load reads the ca and client certificate, nil if nothing is configured
+func (c APITLSConfig) load() (*tls.Config, error) {
+	if c.CAFile == "" && c.CertFile == "" && c.KeyFile == "" {
+		return nil, nil
+	}
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if c.CAFile != "" {
+		data, err := os.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("API.TLS.CAFile: %s", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("API.TLS.CAFile: no certificates in %s", c.CAFile)
+		}
+		config.RootCAs = pool
+	}
+	if c.CertFile != "" || c.KeyFile != "" {
+		if c.CertFile == "" || c.KeyFile == "" {
+			return nil, fmt.Errorf("API.TLS needs both CertFile and KeyFile")
+		}
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("API.TLS: %s", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// requestSignature is the hmac of everything a replayed or changed request would differ in
+func requestSignature(key []byte, method, uri, timestamp, nonce string, body []byte) string {
+	body_hash := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, key)
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%s\n%x", method, uri, timestamp, nonce, body_hash)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// readRequestBody returns the body of req and leaves it readable
+func readRequestBody(req *http.Request) ([]byte, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, nil
+	}
+	body, err := io.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	return body, nil
+}
+
+// signRequest adds a timestamp, a random nonce and their signature with key to req
+func signRequest(req *http.Request, key_id string, key []byte) error {
+	body, err := readRequestBody(req)
+	if err != nil {
+		return err
+	}
+	var nonce [16]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	nonce_hex := hex.EncodeToString(nonce[:])
+	if key_id != "" {
+		req.Header.Set(headerRequestKeyId, key_id)
+	}
+	req.Header.Set(headerRequestTimestamp, timestamp)
+	req.Header.Set(headerRequestNonce, nonce_hex)
+	req.Header.Set(headerRequestSignature, requestSignature(key, req.Method, req.URL.RequestURI(), timestamp, nonce_hex, body))
+	return nil
+}
+
+// VerifyRequest checks the signature of a signed request and that its timestamp is within max_skew.
+// it returns the nonce, the server has to reject nonces it already saw within max_skew to stop replays
+func VerifyRequest(req *http.Request, key []byte, max_skew time.Duration) (string, error) {
+	timestamp := req.Header.Get(headerRequestTimestamp)
+	nonce := req.Header.Get(headerRequestNonce)
+	signature := req.Header.Get(headerRequestSignature)
+	if timestamp == "" || nonce == "" || signature == "" {
+		return "", fmt.Errorf("request is not signed")
+	}
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("bad timestamp %q", timestamp)
+	}
+	skew := time.Since(time.Unix(unix, 0))
+	if skew > max_skew || skew < -max_skew {
+		return "", fmt.Errorf("timestamp is %s off", skew.Round(time.Second))
+	}
+	body, err := readRequestBody(req)
+	if err != nil {
+		return "", err
+	}
+	expected := requestSignature(key, req.Method, req.URL.RequestURI(), timestamp, nonce, body)
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return "", fmt.Errorf("bad signature")
+	}
+	return nonce, nil
+}
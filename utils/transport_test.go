@@ -0,0 +1,274 @@
+package utils_test
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bedrockteam/skin-bot/utils"
+	"github.com/bedrockteam/skin-bot/utils/apitest"
+)
+
+func signedRequest(t *testing.T, key string, body string) *http.Request {
+	req := httptest.NewRequest("POST", "/nodes/node1/heartbeat?x=1", strings.NewReader(body))
+	if err := utils.SignRequest(req, "key1", []byte(key)); err != nil {
+		t.Fatal(err)
+	}
+	return req
+}
+
+// the signature covers the method, uri, body, timestamp and nonce
+func TestVerifyRequest(t *testing.T) {
+	req := signedRequest(t, "secret", `{"Time":1}`)
+	if req.Header.Get("X-Skin-Bot-Key-Id") != "key1" {
+		t.Errorf("key id header is %q", req.Header.Get("X-Skin-Bot-Key-Id"))
+	}
+	if _, err := utils.VerifyRequest(req, []byte("secret"), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, tamper := range map[string]func(req *http.Request){
+		"key":    func(req *http.Request) {},
+		"method": func(req *http.Request) { req.Method = "DELETE" },
+		"uri":    func(req *http.Request) { req.URL.RawQuery = "x=2" },
+		"body":   func(req *http.Request) { req.Body = io.NopCloser(strings.NewReader(`{"Time":2}`)) },
+		"nonce":  func(req *http.Request) { req.Header.Set("X-Skin-Bot-Nonce", "00") },
+		"unsigned": func(req *http.Request) {
+			req.Header.Del("X-Skin-Bot-Signature")
+		},
+	} {
+		req := signedRequest(t, "secret", `{"Time":1}`)
+		tamper(req)
+		key := "secret"
+		if name == "key" {
+			key = "other"
+		}
+		if _, err := utils.VerifyRequest(req, []byte(key), time.Minute); err == nil {
+			t.Errorf("request with a changed %s was accepted", name)
+		}
+	}
+
+	// a captured request cant be sent again later
+	for _, skew := range []time.Duration{-10 * time.Minute, 10 * time.Minute} {
+		req := signedRequest(t, "secret", `{"Time":1}`)
+		req.Header.Set("X-Skin-Bot-Timestamp", strconv.FormatInt(time.Now().Add(skew).Unix(), 10))
+		if _, err := utils.VerifyRequest(req, []byte("secret"), 5*time.Minute); err == nil || !strings.Contains(err.Error(), "off") {
+			t.Errorf("request %s off gave %v", skew, err)
+		}
+	}
+}
+
+// a signed client never sends the key, and a request it sent is refused when replayed
+func TestSignedClient(t *testing.T) {
+	server := apitest.NewServer("secret")
+	t.Cleanup(server.Close)
+
+	var lock sync.Mutex
+	var captured []*http.Request
+	var bodies [][]byte
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body bytes.Buffer
+		body.ReadFrom(r.Body)
+		lock.Lock()
+		captured = append(captured, r.Clone(r.Context()))
+		bodies = append(bodies, body.Bytes())
+		lock.Unlock()
+
+		out, _ := http.NewRequest(r.Method, server.URL+r.URL.RequestURI(), bytes.NewReader(body.Bytes()))
+		out.Header = r.Header.Clone()
+		resp, err := http.DefaultClient.Do(out)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		defer resp.Body.Close()
+		for k, v := range resp.Header {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
+	}))
+	t.Cleanup(proxy.Close)
+
+	config := server.Config()
+	config.Server = proxy.URL
+	config.SignRequests = true
+	config.KeyId = "key1"
+	config.StartRetries = -1
+	client, err := utils.NewClient(config, nil, utils.QueueConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.NodeId = "node1"
+	if err := client.Start(false); err != nil {
+		t.Fatal(err)
+	}
+	client.StartNode(utils.NodeConfig{Register: true, Heartbeat: time.Hour}, utils.NodeInfo{}, func() utils.NodeStatus { return utils.NodeStatus{} })
+	client.Close()
+	if len(server.Nodes()) != 0 {
+		t.Error("node was not deregistered")
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	if len(captured) < 3 {
+		t.Fatalf("only %d requests were sent", len(captured))
+	}
+	for _, r := range captured {
+		if auth := r.Header.Get("Authorization"); auth != "" {
+			t.Errorf("%s %s sent Authorization %q", r.Method, r.URL, auth)
+		}
+		if r.Header.Get("X-Skin-Bot-Signature") == "" {
+			t.Errorf("%s %s is not signed", r.Method, r.URL)
+		}
+	}
+
+	// the registration again, with its nonce already used
+	register := captured[1]
+	if register.Method != "POST" || register.URL.Path != "/nodes" {
+		t.Fatalf("second request was %s %s", register.Method, register.URL)
+	}
+	replay, _ := http.NewRequest("POST", server.URL+"/nodes", bytes.NewReader(bodies[1]))
+	replay.Header = register.Header.Clone()
+	resp, err := http.DefaultClient.Do(replay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("replayed request got %s", resp.Status)
+	}
+	if len(server.Nodes()) != 0 {
+		t.Error("replayed registration was accepted")
+	}
+}
+
+// writePem writes der blocks of type to dir/name
+func writePem(t *testing.T, dir, name, typ string, der []byte) string {
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// issue creates a certificate signed by parent, a self signed CA if parent is nil
+func issue(t *testing.T, template *x509.Certificate, parent *x509.Certificate, parent_key *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	if parent == nil {
+		parent, parent_key = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parent_key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+// the client checks the server against CAFile and shows its client certificate
+func TestAPITLS(t *testing.T) {
+	dir := t.TempDir()
+	ca, ca_key := issue(t, &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil, nil)
+	server_cert, server_key := issue(t, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "api server"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca, ca_key)
+	client_cert, client_key := issue(t, &x509.Certificate{
+		SerialNumber: big.NewInt(3),
+		Subject:      pkix.Name{CommonName: "node1"},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca, ca_key)
+
+	ca_file := writePem(t, dir, "ca.pem", "CERTIFICATE", ca.Raw)
+	cert_file := writePem(t, dir, "client.pem", "CERTIFICATE", client_cert.Raw)
+	key_der, err := x509.MarshalECPrivateKey(client_key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key_file := writePem(t, dir, "client-key.pem", "EC PRIVATE KEY", key_der)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TLS.PeerCertificates) == 0 || r.TLS.PeerCertificates[0].Subject.CommonName != "node1" {
+			http.Error(w, "no client certificate", http.StatusForbidden)
+			return
+		}
+		w.Write([]byte("{}"))
+	}))
+	// the refused handshakes are expected
+	server.Config.ErrorLog = log.New(io.Discard, "", 0)
+	server.TLS = &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{server_cert.Raw}, PrivateKey: server_key}},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}
+	server.StartTLS()
+	t.Cleanup(server.Close)
+
+	start := func(tls_config utils.APITLSConfig) error {
+		client, err := utils.NewClient(utils.APIConfig{
+			Server:       server.URL,
+			Key:          "key",
+			RoutesCache:  filepath.Join(dir, "routes.json"),
+			StartRetries: -1,
+			TLS:          tls_config,
+		}, nil, utils.QueueConfig{})
+		if err != nil {
+			return err
+		}
+		defer client.Close()
+		return client.Start(false)
+	}
+
+	if err := start(utils.APITLSConfig{CAFile: ca_file, CertFile: cert_file, KeyFile: key_file}); err != nil {
+		t.Fatalf("with the CA and client certificate: %s", err)
+	}
+	os.Remove(filepath.Join(dir, "routes.json"))
+	for name, tls_config := range map[string]utils.APITLSConfig{
+		"system CAs":       {CertFile: cert_file, KeyFile: key_file},
+		"no client cert":   {CAFile: ca_file},
+		"cert without key": {CAFile: ca_file, CertFile: cert_file},
+		"missing CAFile":   {CAFile: key_file + ".missing"},
+		"CAFile is a key":  {CAFile: key_file},
+	} {
+		if err := start(tls_config); err == nil {
+			t.Errorf("%s: connected", name)
+		}
+	}
+}
@@ -0,0 +1,251 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// UploadConfig tunes uploading skins to the UploadURL of the api server
+type UploadConfig struct {
+	// BatchSize is the most skins in one request, defaults to 50
+	BatchSize int
+	// Linger is how long the first skin of a batch waits for more, defaults to 1s
+	Linger time.Duration
+	// MaxBackoff caps the wait between retries, defaults to 1m
+	MaxBackoff time.Duration
+	// QueueTimeout is how long a publish may take before the skin is uploaded instead, defaults to 10s
+	QueueTimeout time.Duration
+}
+
+// httpUploader posts batches of skins to the UploadURL from the routes
+type httpUploader struct {
+	client   *Client
+	config   UploadConfig
+	encoding MessageEncoding
+	batcher  *skinBatcher
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func newHTTPUploader(client *Client, config UploadConfig) *httpUploader {
+	if config.BatchSize == 0 {
+		config.BatchSize = 50
+	}
+	if config.Linger == 0 {
+		config.Linger = 1 * time.Second
+	}
+	if config.MaxBackoff == 0 {
+		config.MaxBackoff = 1 * time.Minute
+	}
+	if config.QueueTimeout == 0 {
+		config.QueueTimeout = 10 * time.Second
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	h := &httpUploader{
+		client:   client,
+		config:   config,
+		encoding: MessageEncoding{client.queueConfig.Encoding, client.queueConfig.Compression}.withDefaults(),
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+	batch_config := BatchConfig{Count: config.BatchSize, Linger: config.Linger}
+	h.batcher = newSkinBatcher(batch_config, h.encoding.Format, func(*QueuedSkin) string { return "" }, func(_ string, skins []encodedSkin) error {
+		return h.post(h.ctx, skins)
+	})
+	return h
+}
+
+// Send implements Sink, it waits until the batch with skin is uploaded
+func (h *httpUploader) Send(ctx context.Context, skin *QueuedSkin) error {
+	return h.batcher.add(ctx, skin)
+}
+
+// SendBatch implements batchSink
+func (h *httpUploader) SendBatch(ctx context.Context, skins []*QueuedSkin) error {
+	var encoded []encodedSkin
+	for _, skin := range skins {
+		body, err := encodeSkinBody(skin, h.encoding.Format)
+		if err != nil {
+			return err
+		}
+		encoded = append(encoded, encodedSkin{skin, body})
+	}
+	for _, batch := range h.batcher.split(encoded) {
+		if err := h.post(ctx, batch); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close implements Sink, uploads that are still retrying fail
+func (h *httpUploader) Close() error {
+	h.cancel()
+	return nil
+}
+
+// uploadError is an upload the api server rejected for good
+type uploadError struct {
+	status int
+}
+
+func (e *uploadError) Error() string {
+	return fmt.Sprintf("upload: StatusCode %d", e.status)
+}
+
+// errNoUploadRoute is returned while the routes have no UploadURL, it is not retried
+// so the api sink can pick the queue once the routes have an AMQPUrl
+var errNoUploadRoute = errors.New("the API server has no UploadURL")
+
+// post uploads one batch, retrying with backoff until it is accepted, rejected or ctx is done
+func (h *httpUploader) post(ctx context.Context, skins []encodedSkin) error {
+	bodies := make([][]byte, 0, len(skins))
+	for _, skin := range skins {
+		bodies = append(bodies, skin.body)
+	}
+	body, content_type, err := encodeBatch(bodies, h.encoding)
+	if err != nil {
+		return err
+	}
+
+	backoff := 1 * time.Second
+	for {
+		wait, err := h.postOnce(ctx, body, content_type)
+		if err == nil {
+			return nil
+		}
+		if _, ok := err.(*uploadError); ok || err == errNoUploadRoute {
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		if wait == 0 {
+			// full jitter so nodes dont retry in lockstep
+			wait = time.Duration(rand.Int63n(int64(backoff))) + time.Millisecond
+			backoff *= 2
+			if backoff > h.config.MaxBackoff {
+				backoff = h.config.MaxBackoff
+			}
+		}
+		logrus.Warnf("Upload: %s, retrying in %s", err, wait.Round(time.Millisecond))
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// postOnce makes one upload request, returns how long the server asked to wait before retrying
+func (h *httpUploader) postOnce(ctx context.Context, body []byte, content_type string) (time.Duration, error) {
+	url := h.client.uploadURL()
+	if url == "" {
+		return 0, errNoUploadRoute
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", content_type)
+	resp, err := h.client.doRequest(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	switch {
+	case resp.StatusCode/100 == 2:
+		return 0, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable:
+		return retryAfter(resp.Header.Get("Retry-After")), fmt.Errorf("upload: StatusCode %d", resp.StatusCode)
+	case resp.StatusCode/100 == 5 || resp.StatusCode == http.StatusRequestTimeout:
+		return 0, fmt.Errorf("upload: StatusCode %d", resp.StatusCode)
+	}
+	return 0, &uploadError{resp.StatusCode}
+}
+
+// retryAfter parses a Retry-After header, seconds or a date, 0 if there is none
+func retryAfter(value string) time.Duration {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+// apiSink sends skins to the api server over amqp if the routes have an AMQPUrl
+// and the broker is reachable, and to the UploadURL otherwise
+type apiSink struct {
+	client *Client
+	upload *httpUploader
+}
+
+// Send implements Sink
+func (a *apiSink) Send(ctx context.Context, skin *QueuedSkin) error {
+	return a.send(ctx, func(ctx context.Context) error {
+		return queueSink{a.client}.Send(ctx, skin)
+	}, func() error {
+		return a.upload.Send(ctx, skin)
+	})
+}
+
+// SendBatch implements batchSink
+func (a *apiSink) SendBatch(ctx context.Context, skins []*QueuedSkin) error {
+	return a.send(ctx, func(ctx context.Context) error {
+		return queueSink{a.client}.SendBatch(ctx, skins)
+	}, func() error {
+		return a.upload.SendBatch(ctx, skins)
+	})
+}
+
+// send publishes to the queue, it uploads instead while the queue is disconnected or
+// when publishing takes longer than QueueTimeout, as long as the routes have an UploadURL
+func (a *apiSink) send(ctx context.Context, publish func(ctx context.Context) error, upload func() error) error {
+	if q := a.client.Queue(); q != nil {
+		if a.client.uploadURL() == "" {
+			return publish(ctx)
+		}
+		if q.Connected() {
+			queue_ctx, cancel := context.WithTimeout(ctx, a.upload.config.QueueTimeout)
+			err := publish(queue_ctx)
+			cancel()
+			if err == nil || ctx.Err() != nil {
+				return err
+			}
+			logrus.Warnf("Queue: %s, uploading instead", err)
+		}
+	}
+
+	err := upload()
+	if err == errNoUploadRoute && a.client.Queue() != nil {
+		return publish(ctx)
+	}
+	return err
+}
+
+// Close implements Sink
+func (a *apiSink) Close() error {
+	return a.upload.Close()
+}
@@ -41,7 +41,7 @@ type (
 	PacketFunc func(header packet.Header, payload []byte, src, dst net.Addr)
 )
 
-func ConnectServer(ctx context.Context, address, clientName string, packetFunc PacketFunc) (serverConn *minecraft.Conn, err error) {
+func ConnectServer(ctx context.Context, address string, account Account, packetFunc PacketFunc) (serverConn *minecraft.Conn, err error) {
 	var local_addr net.Addr
 	packet_func := func(header packet.Header, payload []byte, src, dst net.Addr) {
 		if G_debug {
@@ -52,19 +52,31 @@ func ConnectServer(ctx context.Context, address, clientName string, packetFunc P
 		}
 	}
 
-	key, chainData, err := GetChain(clientName)
-	if err != nil {
-		return nil, err
+	dialer := minecraft.Dialer{
+		PacketFunc:    packet_func,
+		DownloadPacks: false,
+	}
+	if account.Offline {
+		// no TokenSource makes the dialer sign the login with the key itself
+		dialer.Key, err = getOfflineChain(account.Name)
+		if err != nil {
+			return nil, err
+		}
+		dialer.ChainData = offlineChain
+		dialer.IdentityData = account.offlineIdentity()
+	} else {
+		dialer.Key, dialer.ChainData, err = GetChain(account.Name)
+		if err != nil {
+			return nil, err
+		}
+		dialer.TokenSource, err = GetTokenSource(account.Name)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	logrus.Infof("Connecting to %s", address)
-	serverConn, err = minecraft.Dialer{
-		TokenSource:   GetTokenSource(clientName),
-		PacketFunc:    packet_func,
-		DownloadPacks: false,
-		Key:           key,
-		ChainData:     chainData,
-	}.DialContext(ctx, "raknet", address)
+	serverConn, err = dialer.DialContext(ctx, "raknet", address)
 	if err != nil {
 		return nil, err
 	}
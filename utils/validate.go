@@ -0,0 +1,29 @@
+package utils
+
+import (
+	"encoding/base64"
+	"fmt"
+)
+
+// ValidateSkin checks that a skin from the queue is complete enough to be used
+func ValidateSkin(skin *QueuedSkin) error {
+	if skin.Skin == nil {
+		return fmt.Errorf("no skin data")
+	}
+	if len(skin.Xuid) < 5 {
+		return fmt.Errorf("invalid xuid %q", skin.Xuid)
+	}
+	if CleanupName(skin.Username) == "" {
+		return fmt.Errorf("invalid username %q", skin.Username)
+	}
+
+	data, err := base64.RawStdEncoding.DecodeString(skin.Skin.SkinData)
+	if err != nil {
+		return fmt.Errorf("SkinData: %s", err)
+	}
+	w, h := skin.Skin.SkinImageWidth, skin.Skin.SkinImageHeight
+	if w == 0 || h == 0 || len(data) != int(w*h*4) {
+		return fmt.Errorf("SkinData is %d bytes for %dx%d", len(data), w, h)
+	}
+	return nil
+}